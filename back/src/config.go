@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"github.com/diyor28/not-agar/src/gamengine"
+	"github.com/diyor28/not-agar/src/sockethub"
+	"log"
+	"os"
+	"strings"
+)
+
+// defaults are the game's own hub settings, the flags below only override
+// how clients connect.
+var defaults = gamengine.HubConfig()
+
+var allowedOrigins = flag.String("allowed-origins", "*", "comma separated origins browsers may connect from, empty for same origin only")
+
+var compress = flag.Bool("compress", true, "negotiate permessage-deflate with clients supporting it")
+
+var readLimit = flag.Int64("read-limit", defaults.ReadLimit, "largest message accepted from clients in bytes, larger ones close the connection")
+
+var readBufferSize = flag.Int("read-buffer-size", defaults.ReadBufferSize, "websocket read buffer size in bytes")
+
+var writeBufferSize = flag.Int("write-buffer-size", defaults.WriteBufferSize, "websocket write buffer size in bytes")
+
+var subprotocols = flag.String("subprotocols", "", "comma separated websocket subprotocols supported, in order of preference")
+
+var trustedProxies = flag.String("trusted-proxies", "", "comma separated IPs or CIDR ranges of reverse proxies whose X-Forwarded-For header is trusted to ban clients")
+
+var handshakeTimeout = flag.Duration("handshake-timeout", defaults.HandshakeTimeout, "time allowed for the websocket handshake")
+
+// loadEnv sets every flag from its environment variable, the flag name in
+// upper case with dashes replaced by underscores, e.g. READ_LIMIT. It runs
+// before flag.Parse, so the command line still wins.
+func loadEnv() {
+	flag.VisitAll(func(f *flag.Flag) {
+		name := strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, ok := os.LookupEnv(name); ok {
+			if err := f.Value.Set(value); err != nil {
+				log.Fatalf("invalid %s: %v", name, err)
+			}
+		}
+	})
+}
+
+// splitList splits a comma separated flag, an empty one gives nil.
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func hubConfig() sockethub.Config {
+	config := defaults
+	config.ReadLimit = *readLimit
+	config.ReadBufferSize = *readBufferSize
+	config.WriteBufferSize = *writeBufferSize
+	config.AllowedOrigins = splitList(*allowedOrigins)
+	config.Subprotocols = splitList(*subprotocols)
+	config.HandshakeTimeout = *handshakeTimeout
+	config.EnableCompression = *compress
+	config.TrustedProxies = splitList(*trustedProxies)
+	return config
+}
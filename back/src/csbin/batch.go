@@ -0,0 +1,45 @@
+package csbin
+
+import (
+	"errors"
+	"fmt"
+	"github.com/diyor28/not-agar/src/csbin/bytesIO"
+	"math"
+)
+
+// EncodeBatch writes messages as a uint16 count followed by every message
+// prefixed with its uint32 length. The layout matches a slice field of byte
+// strings with MaxLen(math.MaxUint32), so clients can read it with a schema.
+func EncodeBatch(messages [][]byte, writer *bytesIO.BytesWriter) error {
+	if len(messages) > math.MaxUint16 {
+		return errors.New(fmt.Sprintf("expected batch of length <= %d, got %d", math.MaxUint16, len(messages)))
+	}
+	writer.WriteUint16(uint16(len(messages)), "batch length")
+	for _, message := range messages {
+		if uint64(len(message)) > math.MaxUint32 {
+			return errors.New(fmt.Sprintf("expected message of length <= %d, got %d", uint64(math.MaxUint32), len(message)))
+		}
+		writer.WriteUint32(uint32(len(message)), "message length")
+		writer.WriteBytes(message, "message")
+	}
+	return nil
+}
+
+// DecodeBatch reads messages written by EncodeBatch.
+func DecodeBatch(reader *bytesIO.BytesReader) ([][]byte, error) {
+	count, err := reader.ReadUint16()
+	if err != nil {
+		return nil, err
+	}
+	messages := make([][]byte, count)
+	for i := range messages {
+		length, err := reader.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		if messages[i], err = reader.ReadBytes(int(length)); err != nil {
+			return nil, errors.New(fmt.Sprintf("At %d %s", i, err.Error()))
+		}
+	}
+	return messages, nil
+}
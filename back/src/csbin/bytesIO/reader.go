@@ -7,6 +7,8 @@ import (
 	"errors"
 	"fmt"
 	"github.com/diyor28/not-agar/src/csbin/bitmask"
+	"io"
+	"math"
 )
 
 func NewReader(data []byte) *BytesReader {
@@ -15,8 +17,9 @@ func NewReader(data []byte) *BytesReader {
 }
 
 type BytesReader struct {
-	Bytes  []byte
-	reader *bytes.Reader
+	Bytes   []byte
+	reader  *bytes.Reader
+	scratch [8]byte
 }
 
 func (r *BytesReader) Decompress() error {
@@ -40,16 +43,28 @@ func (r *BytesReader) ReadByte() (byte, error) {
 	return r.reader.ReadByte()
 }
 
-func (r BytesReader) ReadBytes(n int) ([]byte, error) {
+func (r *BytesReader) ReadBytes(n int) ([]byte, error) {
+	if n < 0 || n > r.reader.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
 	result := make([]byte, n)
-	_, err := r.reader.Read(result)
-	if err != nil {
+	if _, err := io.ReadFull(r.reader, result); err != nil {
 		return nil, err
 	}
 	return result, nil
 }
 
-func (r BytesReader) ReadUint(n int) (uint64, error) {
+// readFixed reads n <= 8 bytes into a buffer that is only valid until the
+// next read, which keeps fixed size reads from allocating.
+func (r *BytesReader) readFixed(n int) ([]byte, error) {
+	b := r.scratch[:n]
+	if _, err := io.ReadFull(r.reader, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+func (r *BytesReader) ReadUint(n int) (uint64, error) {
 	switch n {
 	case 1:
 		u, err := r.ReadUint8()
@@ -94,7 +109,7 @@ func (r *BytesReader) ReadUint8() (uint8, error) {
 }
 
 func (r *BytesReader) ReadUint16() (uint16, error) {
-	uBytes, err := r.ReadBytes(2)
+	uBytes, err := r.readFixed(2)
 	if err != nil {
 		return 0, err
 	}
@@ -102,7 +117,7 @@ func (r *BytesReader) ReadUint16() (uint16, error) {
 }
 
 func (r *BytesReader) ReadUint32() (uint32, error) {
-	uBytes, err := r.ReadBytes(4)
+	uBytes, err := r.readFixed(4)
 	if err != nil {
 		return 0, err
 	}
@@ -110,7 +125,7 @@ func (r *BytesReader) ReadUint32() (uint32, error) {
 }
 
 func (r *BytesReader) ReadUint64() (uint64, error) {
-	uBytes, err := r.ReadBytes(8)
+	uBytes, err := r.readFixed(8)
 	if err != nil {
 		return 0, err
 	}
@@ -163,7 +178,7 @@ func (r *BytesReader) ReadInt64() (int64, error) {
 	return int64(v), err
 }
 
-func (r BytesReader) ReadFloat(n int) (float64, error) {
+func (r *BytesReader) ReadFloat(n int) (float64, error) {
 	switch n {
 	case 4:
 		f, err := r.ReadFloat32()
@@ -178,29 +193,19 @@ func (r BytesReader) ReadFloat(n int) (float64, error) {
 }
 
 func (r *BytesReader) ReadFloat32() (float32, error) {
-	fBytes, err := r.ReadBytes(4)
+	u, err := r.ReadUint32()
 	if err != nil {
 		return 0, err
 	}
-	var res float32
-	err = binary.Read(bytes.NewReader(fBytes), binary.BigEndian, &res)
-	if err != nil {
-		return 0, err
-	}
-	return res, nil
+	return math.Float32frombits(u), nil
 }
 
 func (r *BytesReader) ReadFloat64() (float64, error) {
-	fBytes, err := r.ReadBytes(8)
-	if err != nil {
-		return 0, err
-	}
-	var res float64
-	err = binary.Read(bytes.NewReader(fBytes), binary.BigEndian, &res)
+	u, err := r.ReadUint64()
 	if err != nil {
 		return 0, err
 	}
-	return res, nil
+	return math.Float64frombits(u), nil
 }
 
 func (r *BytesReader) ReadString(len uint64, maxLen uint64) (string, error) {
@@ -213,6 +218,9 @@ func (r *BytesReader) ReadString(len uint64, maxLen uint64) (string, error) {
 		} else {
 			return "", err
 		}
+		if length > maxLen {
+			return "", errors.New(fmt.Sprintf("expected a string of length <= %d, got %d", maxLen, length))
+		}
 	} else {
 		if l, err := r.ReadUint16(); err == nil {
 			length = uint64(l)
@@ -220,9 +228,12 @@ func (r *BytesReader) ReadString(len uint64, maxLen uint64) (string, error) {
 			return "", err
 		}
 	}
+	if length > uint64(r.reader.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
 	sBytes, err := r.ReadBytes(int(length))
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 	return string(sBytes), nil
 }
@@ -113,6 +113,9 @@ func (w *BytesWriter) WriteString(s string, explanation string, length uint64, m
 		}
 		w.WriteUint(sLen, bitmask.MinBytes(maxLen), explanation)
 	} else {
+		if sLen > math.MaxUint16 {
+			return errors.New(fmt.Sprintf("expected a string of length <= %d, got %d", math.MaxUint16, len(s)))
+		}
 		w.WriteUint16(uint16(sLen), "string length")
 	}
 	w.WriteBytes([]byte(s), explanation)
@@ -5,13 +5,16 @@ import (
 	"fmt"
 	"github.com/diyor28/not-agar/src/csbin/bitmask"
 	"github.com/diyor28/not-agar/src/csbin/bytesIO"
+	"math"
 	"reflect"
 	"strings"
+	"time"
 )
 
 type Field struct {
 	Name       string
 	Type       reflect.Kind
+	structName string
 	optional   bool
 	loc        string
 	structType *reflect.Type
@@ -19,10 +22,12 @@ type Field struct {
 	subFields  Fields
 	maxLen     uint64
 	len        uint64
+	extType    reflect.Type
+	unit       time.Duration
 }
 
 func NewField(name string, primitiveType reflect.Kind) *Field {
-	return &Field{Name: name, loc: name, Type: primitiveType}
+	return &Field{Name: name, loc: name, structName: strings.Title(name), Type: primitiveType}
 }
 
 func (f *Field) Len(exactLen uint64) *Field {
@@ -81,27 +86,32 @@ func (f *Field) SubFields(fields ...*Field) *Field {
 	return f
 }
 
+func (f *Fields) fieldValue(reflection *reflect.Value, field *Field) (string, reflect.Value) {
+	if reflection.Kind() == reflect.Map {
+		mapEl := reflection.MapIndex(reflect.ValueOf(field.Name))
+		if !mapEl.IsValid() {
+			return field.Name, mapEl
+		}
+		if mapEl.Kind() == reflect.Interface {
+			return field.Name, mapEl.Elem()
+		}
+		return field.Name, mapEl
+	}
+	return field.structName, reflection.FieldByName(field.structName)
+}
+
 func (f *Fields) writeBitmask(reflection *reflect.Value, writer *bytesIO.BytesWriter) error {
 	bMask := bitmask.New()
 	for _, field := range *f {
-		var fieldName string
-		var value reflect.Value
-		if reflection.Kind() == reflect.Map {
-			fieldName = field.Name
-			mapEl := reflection.MapIndex(reflect.ValueOf(fieldName))
-			if !mapEl.IsValid() {
+		fieldName, value := f.fieldValue(reflection, field)
+		if !field.optional {
+			if !value.IsValid() {
 				return errors.New(fmt.Sprintf("key %s does not exist", fieldName))
 			}
-			value = mapEl.Elem()
-		} else {
-			fieldName = strings.Title(field.Name)
-			value = reflection.FieldByName(fieldName)
-		}
-		if value.IsZero() {
-			bMask.Set(false)
-		} else {
 			bMask.Set(true)
+			continue
 		}
+		bMask.Set(value.IsValid() && !value.IsZero())
 	}
 	writer.WriteBytes(bMask.ToBytes(), "bitmask")
 	return nil
@@ -124,16 +134,8 @@ func (f *Fields) Encode(reflection *reflect.Value, writer *bytesIO.BytesWriter)
 	}
 
 	for _, field := range *f {
-		var fieldName string
-		var value reflect.Value
-		if reflection.Kind() == reflect.Map {
-			fieldName = field.Name
-			value = reflection.MapIndex(reflect.ValueOf(fieldName)).Elem()
-		} else {
-			fieldName = strings.Title(field.Name)
-			value = reflection.FieldByName(fieldName)
-		}
-		if value.IsZero() && field.optional {
+		fieldName, value := f.fieldValue(reflection, field)
+		if field.optional && (!value.IsValid() || value.IsZero()) {
 			continue
 		}
 		if !value.IsValid() {
@@ -148,6 +150,10 @@ func (f *Fields) Encode(reflection *reflect.Value, writer *bytesIO.BytesWriter)
 }
 
 func (f *Fields) Decode(reflection *reflect.Value, reader *bytesIO.BytesReader) error {
+	return f.decode(*reflection, reader, false)
+}
+
+func (f *Fields) decode(reflection reflect.Value, reader *bytesIO.BytesReader, reuse bool) error {
 	var bMask *bitmask.Bitmask
 	var err error
 	if f.hasOptionalFields() {
@@ -158,6 +164,13 @@ func (f *Fields) Decode(reflection *reflect.Value, reader *bytesIO.BytesReader)
 	}
 	for i, field := range *f {
 		if bMask != nil && !bMask.Has(i, len(*f)) {
+			if reuse && reflection.Kind() == reflect.Struct {
+				if value := reflection.FieldByName(field.structName); value.CanSet() {
+					value.Set(reflect.Zero(value.Type()))
+				}
+			} else if reuse && reflection.Kind() == reflect.Map {
+				reflection.SetMapIndex(reflect.ValueOf(field.Name), reflect.Value{})
+			}
 			continue
 		}
 		var fieldName string
@@ -166,7 +179,7 @@ func (f *Fields) Decode(reflection *reflect.Value, reader *bytesIO.BytesReader)
 			fieldName = field.Name
 			value = reflect.New(field.ConstructType()).Elem()
 		} else {
-			fieldName = strings.Title(field.Name)
+			fieldName = field.structName
 			value = reflection.FieldByName(fieldName)
 		}
 
@@ -176,7 +189,7 @@ func (f *Fields) Decode(reflection *reflect.Value, reader *bytesIO.BytesReader)
 		if !value.CanSet() {
 			return errors.New(fmt.Sprintf("field %s is not writeable", fieldName))
 		}
-		err := field.Decode(&value, reader)
+		err := field.decode(value, reader, reuse)
 		if err != nil {
 			return errors.New(fmt.Sprintf("%s: %s", field.Name, err.Error()))
 		}
@@ -188,6 +201,25 @@ func (f *Fields) Decode(reflection *reflect.Value, reader *bytesIO.BytesReader)
 }
 
 func (f *Field) Decode(value *reflect.Value, reader *bytesIO.BytesReader) error {
+	return f.decode(*value, reader, false)
+}
+
+func (f *Field) decode(value reflect.Value, reader *bytesIO.BytesReader, reuse bool) error {
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() || !reuse {
+			value.Set(reflect.New(value.Type().Elem()))
+		}
+		return f.decode(value.Elem(), reader, reuse)
+	}
+	if f.extType != nil {
+		return f.decodeExt(value, reader)
+	}
+	if f.Type == reflect.Struct && value.Kind() == reflect.Map {
+		return f.decodeMap(value, reader, reuse)
+	}
+	if f.Type == reflect.Array && value.Kind() == reflect.Slice {
+		return f.decodeArray(value, reader, reuse)
+	}
 	if f.Type != value.Kind() {
 		return errors.New(fmt.Sprintf("at %s expected: %s, got: %s", f.loc, f.Type, value.Kind()))
 	}
@@ -205,6 +237,7 @@ func (f *Field) Decode(value *reflect.Value, reader *bytesIO.BytesReader) error
 			return err
 		}
 		value.SetBool(b)
+		return nil
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		u, err := reader.ReadUint(f.Size())
 		if err != nil {
@@ -227,43 +260,52 @@ func (f *Field) Decode(value *reflect.Value, reader *bytesIO.BytesReader) error
 		value.SetFloat(i)
 		return nil
 	case reflect.Struct:
-		err := f.subFields.Decode(value, reader)
+		err := f.subFields.decode(value, reader, reuse)
 		if err != nil {
 			return err
 		}
 		return nil
-	case reflect.Slice:
-		err := f.DecodeArray(value, reader)
+	case reflect.Slice, reflect.Array:
+		err := f.decodeArray(value, reader, reuse)
 		if err != nil {
 			return err
 		}
 		return nil
 	case reflect.Map:
-		err := f.subFields.Decode(value, reader)
-		if err != nil {
-			return err
-		}
+		return f.decodeMap(value, reader, reuse)
 	}
 	return errors.New(fmt.Sprintf("type %s is not supported", value.Kind().String()))
 }
 
+func (f *Field) decodeMap(value reflect.Value, reader *bytesIO.BytesReader, reuse bool) error {
+	if value.IsNil() || !reuse {
+		value.Set(reflect.MakeMap(value.Type()))
+	}
+	return f.subFields.decode(value, reader, reuse)
+}
+
 func (f *Field) Encode(value *reflect.Value, writer *bytesIO.BytesWriter) error {
 	if value.Kind() == reflect.Ptr {
 		elem := value.Elem()
 		return f.Encode(&elem, writer)
 	}
+	if f.extType != nil {
+		return f.encodeExt(value, writer)
+	}
+	if f.Type == reflect.Struct && value.Kind() == reflect.Map {
+		return f.subFields.Encode(value, writer)
+	}
 	if f.Type != value.Kind() {
 		return errors.New(fmt.Sprintf("at %s expected: %s, got: %s", f.loc, f.Type, value.Kind()))
 	}
 	switch value.Kind() {
 	case reflect.String:
-		writer.WriteString(value.String(), f.loc, f.len, f.maxLen)
-		return nil
+		return writer.WriteString(value.String(), f.loc, f.len, f.maxLen)
 	case reflect.Bool:
 		writer.WriteBool(value.Bool(), f.loc)
 		return nil
 	case reflect.Uint:
-		writer.WriteNumeric(uint(value.Uint()), f.loc)
+		writer.WriteNumeric(value.Uint(), f.loc)
 		return nil
 	case reflect.Uint8:
 		writer.WriteNumeric(uint8(value.Uint()), f.loc)
@@ -327,6 +369,10 @@ func (f *Field) Encode(value *reflect.Value, writer *bytesIO.BytesWriter) error
 }
 
 func (f *Field) DecodeArray(value *reflect.Value, reader *bytesIO.BytesReader) error {
+	return f.decodeArray(*value, reader, false)
+}
+
+func (f *Field) decodeArray(value reflect.Value, reader *bytesIO.BytesReader, reuse bool) error {
 	var arrLength uint64
 	if f.len > 0 {
 		arrLength = f.len
@@ -336,6 +382,9 @@ func (f *Field) DecodeArray(value *reflect.Value, reader *bytesIO.BytesReader) e
 		} else {
 			return err
 		}
+		if arrLength > f.maxLen {
+			return errors.New(fmt.Sprintf("expected array of length <= %d, got %d", f.maxLen, arrLength))
+		}
 	} else {
 		if aLen, err := reader.ReadUint16(); err == nil {
 			arrLength = uint64(aLen)
@@ -343,14 +392,24 @@ func (f *Field) DecodeArray(value *reflect.Value, reader *bytesIO.BytesReader) e
 			return err
 		}
 	}
-	value.Set(reflect.MakeSlice(f.ConstructType(), int(arrLength), int(arrLength)))
+	if value.Kind() == reflect.Array {
+		if uint64(value.Len()) != arrLength {
+			return errors.New(fmt.Sprintf("expected array of length %d, got %d", value.Len(), arrLength))
+		}
+	} else if reuse && !value.IsNil() && value.Cap() >= int(arrLength) {
+		value.SetLen(int(arrLength))
+	} else {
+		slice := reflect.MakeSlice(value.Type(), int(arrLength), int(arrLength))
+		if reuse {
+			reflect.Copy(slice, value)
+		}
+		value.Set(slice)
+	}
 	for i := 0; i < int(arrLength); i++ {
-		el := reflect.New(f.subType.ConstructType()).Elem()
-		err := f.subType.Decode(&el, reader)
+		err := f.subType.decode(value.Index(i), reader, reuse)
 		if err != nil {
 			return errors.New(fmt.Sprintf("At %d ", i) + err.Error())
 		}
-		value.Index(i).Set(el)
 	}
 	return nil
 }
@@ -382,12 +441,20 @@ func (f *Field) EncodeArray(value *reflect.Value, writer *bytesIO.BytesWriter) e
 		writer.WriteUint(arrLen, bitmask.MinBytes(f.maxLen), "array length")
 		return f.encodeArray(value, writer)
 	}
+	if arrLen > math.MaxUint16 {
+		return errors.New(fmt.Sprintf("expected array of length <= %d, got %d", math.MaxUint16, arrLen))
+	}
 	writer.WriteUint16(uint16(arrLen), "array length")
 	return f.encodeArray(value, writer)
 }
 
 func (f *Field) ConstructType() reflect.Type {
+	if f.extType != nil {
+		return f.extType
+	}
 	switch f.Type {
+	case reflect.Uint:
+		return reflect.TypeOf(uint(0))
 	case reflect.Uint8:
 		return reflect.TypeOf(uint8(0))
 	case reflect.Uint16:
@@ -396,6 +463,8 @@ func (f *Field) ConstructType() reflect.Type {
 		return reflect.TypeOf(uint32(0))
 	case reflect.Uint64:
 		return reflect.TypeOf(uint64(0))
+	case reflect.Int:
+		return reflect.TypeOf(0)
 	case reflect.Int8:
 		return reflect.TypeOf(int8(0))
 	case reflect.Int16:
@@ -414,9 +483,17 @@ func (f *Field) ConstructType() reflect.Type {
 		return reflect.TypeOf(false)
 	case reflect.Slice:
 		return reflect.SliceOf(f.subType.ConstructType())
+	case reflect.Array:
+		if f.len == 0 {
+			return reflect.SliceOf(f.subType.ConstructType())
+		}
+		return reflect.ArrayOf(int(f.len), f.subType.ConstructType())
 	case reflect.Map:
 		return reflect.TypeOf(map[string]interface{}{})
 	case reflect.Struct:
+		if f.structType == nil {
+			return reflect.TypeOf(map[string]interface{}{})
+		}
 		return *f.structType
 	}
 	panic(fmt.Sprintf("could not convert type %s to reflect.Type", f.Type.String()))
@@ -430,7 +507,7 @@ func (f *Field) Size() int {
 		return 2
 	case reflect.Uint32, reflect.Int32, reflect.Float32:
 		return 4
-	case reflect.Uint64, reflect.Int64, reflect.Float64:
+	case reflect.Uint, reflect.Int, reflect.Uint64, reflect.Int64, reflect.Float64:
 		return 8
 	}
 	panic(fmt.Sprintf("type %s has no size", f.Type.String()))
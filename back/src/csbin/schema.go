@@ -37,7 +37,7 @@ func (s *Schema) Add(fields ...*Field) *Schema {
 }
 
 func (s *Schema) NewField(name string, primitiveType reflect.Kind) *Field {
-	field := &Field{Name: name, loc: name, Type: primitiveType}
+	field := NewField(name, primitiveType)
 	s.Fields = append(s.Fields, field)
 	return field
 }
@@ -65,6 +65,19 @@ func (s *Schema) Encode(data interface{}) (*bytesIO.BytesWriter, error) {
 }
 
 func (s *Schema) Decode(data []byte, result interface{}) error {
+	return s.decode(data, result, false)
+}
+
+// DecodeInto works like Decode, but reuses the capacity of slices, the maps
+// and the structs pointed to by non-nil pointers already present in result,
+// where Decode allocates new ones, so that decoding a stream of messages into
+// the same value does not allocate for every message. Optional fields missing
+// from data are reset to zero.
+func (s *Schema) DecodeInto(data []byte, result interface{}) error {
+	return s.decode(data, result, true)
+}
+
+func (s *Schema) decode(data []byte, result interface{}, reuse bool) error {
 	reflection := reflect.ValueOf(result)
 	if reflection.Kind() != reflect.Ptr {
 		return errors.New(fmt.Sprintf("expected pointer to struct or map, got %s", reflection.Kind().String()))
@@ -79,5 +92,5 @@ func (s *Schema) Decode(data []byte, result interface{}) error {
 			return err
 		}
 	}
-	return s.Fields.Decode(&reflection, reader)
+	return s.Fields.decode(reflection, reader, reuse)
 }
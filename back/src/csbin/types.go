@@ -0,0 +1,125 @@
+package csbin
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/diyor28/not-agar/src/csbin/bytesIO"
+	"github.com/frankenbeanies/uuid4"
+	"reflect"
+	"time"
+)
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+	uuidType     = reflect.TypeOf(uuid4.UUID4{})
+)
+
+const uuidLen = 16
+
+// NewTimeField encodes a time.Time as an int64 number of units since the Unix
+// epoch, unit must be time.Millisecond or time.Microsecond. Decoded times are
+// in UTC and truncated to unit.
+func NewTimeField(name string, unit time.Duration) *Field {
+	if unit != time.Millisecond && unit != time.Microsecond {
+		panic(fmt.Sprintf("unit %s is not supported, expected: 1ms or 1µs", unit))
+	}
+	f := NewField(name, reflect.Struct)
+	f.extType = timeType
+	f.unit = unit
+	return f
+}
+
+// NewDurationField encodes a time.Duration as an int64 number of units.
+func NewDurationField(name string, unit time.Duration) *Field {
+	if unit <= 0 {
+		panic(fmt.Sprintf("unit %s is not supported, expected a positive duration", unit))
+	}
+	f := NewField(name, reflect.Int64)
+	f.extType = durationType
+	f.unit = unit
+	return f
+}
+
+// NewUUIDField encodes a uuid4.UUID4 as its 16 raw bytes.
+func NewUUIDField(name string) *Field {
+	f := NewField(name, reflect.Array)
+	f.extType = uuidType
+	f.len = uuidLen
+	return f
+}
+
+func (f *Field) encodeExt(value *reflect.Value, writer *bytesIO.BytesWriter) error {
+	if err := f.checkExt(value); err != nil {
+		return err
+	}
+	switch f.extType {
+	case timeType:
+		t := value.Interface().(time.Time)
+		perSecond := int64(time.Second / f.unit)
+		writer.WriteInt64(t.Unix()*perSecond+int64(t.Nanosecond())/int64(f.unit), f.loc)
+	case durationType:
+		writer.WriteInt64(value.Int()/int64(f.unit), f.loc)
+	case uuidType:
+		writer.WriteBytes(value.Interface().(uuid4.UUID4).Bytes(), f.loc)
+	}
+	return nil
+}
+
+func (f *Field) decodeExt(value reflect.Value, reader *bytesIO.BytesReader) error {
+	if err := f.checkExt(&value); err != nil {
+		return err
+	}
+	switch f.extType {
+	case timeType:
+		units, err := reader.ReadInt64()
+		if err != nil {
+			return err
+		}
+		perSecond := int64(time.Second / f.unit)
+		t := time.Unix(units/perSecond, units%perSecond*int64(f.unit)).UTC()
+		value.Set(reflect.ValueOf(t))
+	case durationType:
+		units, err := reader.ReadInt64()
+		if err != nil {
+			return err
+		}
+		value.SetInt(units * int64(f.unit))
+	case uuidType:
+		b, err := reader.ReadBytes(uuidLen)
+		if err != nil {
+			return err
+		}
+		// the zero UUID4 has no bytes and can't even be formatted, it is
+		// never a valid value
+		if isZero(b) {
+			return errors.New(fmt.Sprintf("at %s expected: %s, got: zero bytes", f.loc, f.extType))
+		}
+		uuid, err := uuid4.ParseString(hex.EncodeToString(b))
+		if err != nil {
+			return err
+		}
+		value.Set(reflect.ValueOf(uuid))
+	}
+	return nil
+}
+
+func (f *Field) checkExt(value *reflect.Value) error {
+	if !value.IsValid() {
+		return errors.New(fmt.Sprintf("at %s expected: %s, got: %s", f.loc, f.extType, value.Kind()))
+	}
+	if value.Type() != f.extType {
+		return errors.New(fmt.Sprintf("at %s expected: %s, got: %s", f.loc, f.extType, value.Type()))
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
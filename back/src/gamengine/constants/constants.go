@@ -14,6 +14,7 @@ const (
 	MinZoom                    = 0.7
 	MaxZoom                    = 1.5
 	MaxPlayers                 = 20
+	MaxRooms                   = 50
 	MaxSpikes                  = MaxPlayers * 2
 	StatsNumber                = 10
 	NumFoodResponse            = 30
@@ -36,4 +37,9 @@ const (
 	PlayersUpdate
 	StatsUpdate
 	Rip
+	Batch
+	Resume
+	ResumeFailed
+	RoomFull
+	Announcement
 )
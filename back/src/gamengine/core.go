@@ -50,64 +50,174 @@ func castPoints(points []*shell.Point) []*schemas.Point {
 }
 
 type GameEngine struct {
-	Hub        *sockethub.Hub
+	Hub *sockethub.Hub
+	// Name is the room the engine runs when it belongs to a GameServer, its
+	// clients share the hub with the other rooms.
+	Name       string
 	Map        *_map.Map
 	PlayersMap map[*sockethub.Client]entity.Id
-	framerate  int
-	runEvery   time.Duration
+	// playerClients is the reverse of PlayersMap, see bindPlayer.
+	playerClients map[entity.Id]*sockethub.Client
+	framerate     int
+	runEvery      time.Duration
+	outbox        *Outbox
+	// mu guards Map and PlayersMap, the tick loop and the hub callbacks run
+	// on different goroutines.
+	mu sync.Mutex
+	// disconnected receives clients dropped by the hub so that their players
+	// are removed between ticks rather than from the hub goroutine.
+	disconnected chan *sockethub.Client
+	// SessionGrace is how long the player of a dropped client waits for it to
+	// resume, zero removes the player right away.
+	SessionGrace time.Duration
+	// FreezeDetached keeps players waiting for their client still instead of
+	// letting them drift.
+	FreezeDetached bool
+	sessions       map[string]*session
+	playerSessions map[entity.Id]*session
+	// quit stops the tick loop and the stats publishers, see Stop.
+	quit     chan struct{}
+	stopOnce sync.Once
 }
 
 func NewGameMap(framerate int) *GameEngine {
-	hub := sockethub.NewHub()
+	return NewGameMapWithConfig(framerate, HubConfig())
+}
+
+func NewGameMapWithConfig(framerate int, config sockethub.Config) *GameEngine {
+	return newGameEngine(framerate, sockethub.NewHubWithConfig(config))
+}
+
+func newGameEngine(framerate int, hub *sockethub.Hub) *GameEngine {
 	gameMap := _map.New()
 	delta := time.Duration(1000/framerate) * time.Millisecond
 	engine := GameEngine{
-		Hub:        hub,
-		Map:        gameMap,
-		PlayersMap: make(map[*sockethub.Client]entity.Id),
-		framerate:  framerate,
-		runEvery:   delta,
+		Hub:           hub,
+		Map:           gameMap,
+		PlayersMap:    make(map[*sockethub.Client]entity.Id),
+		playerClients: make(map[entity.Id]*sockethub.Client),
+		framerate:     framerate,
+		runEvery:      delta,
+		outbox:        NewOutbox(),
+
+		disconnected: make(chan *sockethub.Client, 64),
+
+		SessionGrace:   30 * time.Second,
+		sessions:       make(map[string]*session),
+		playerSessions: make(map[entity.Id]*session),
+		quit:           make(chan struct{}),
 	}
 	return &engine
 }
 
 func (eng *GameEngine) Loop() {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+	eng.removeDisconnected()
+	eng.expireSessions()
 	eng.Map.PopulateBots()
 	eng.populateFood()
+	// positions are all updated before anyone is notified, notifyPlayer reads
+	// the neighbours of each player
 	var wg sync.WaitGroup
 	for i := range eng.Map.Players.Players {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
 			pl := eng.Map.Players.Players[i]
+			if eng.isFrozen(pl) {
+				return
+			}
 			if pl.IsBot {
 				eng.MakeMove(pl)
 			}
 			pl.UpdatePosition(eng.runEvery)
 			pl.PassiveWeightLoss()
-			if pl.IsBot {
-				return
-			}
-			err := eng.notifyPlayer(pl)
+		}(i)
+	}
+	wg.Wait()
+	for client, id := range eng.PlayersMap {
+		pl, err := eng.Map.Players.Get(id)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(pl *players.Player, client *sockethub.Client) {
+			defer wg.Done()
+			err := eng.notifyPlayer(pl, client)
 			if err != nil {
 				log.Println("error when calling eng.notifyPlayer(): ", err)
 			}
-		}(i)
+		}(pl, client)
 	}
 	wg.Wait()
 	eng.removeDeadPlayers()
 	eng.removeEatableFood()
+	eng.flushOutbox()
 }
 
-func (eng *GameEngine) PlayerReverseLookUp(id entity.Id) (*sockethub.Client, error) {
-	for k, pId := range eng.PlayersMap {
-		if pId == id {
-			return k, nil
+func (eng *GameEngine) flushOutbox() {
+	for client, err := range eng.outbox.Flush() {
+		log.Println("error when flushing outbox: ", err)
+		eng.detach(client)
+	}
+}
+
+func (eng *GameEngine) removeDisconnected() {
+	for {
+		select {
+		case client := <-eng.disconnected:
+			eng.detach(client)
+		default:
+			return
 		}
 	}
+}
+
+func (eng *GameEngine) PlayerReverseLookUp(id entity.Id) (*sockethub.Client, error) {
+	if client, ok := eng.playerClients[id]; ok {
+		return client, nil
+	}
 	return nil, errors.New(fmt.Sprintf("no players for id %d found", id))
 }
 
+// bindPlayer makes client control the player with id, replacing whatever
+// either of them was bound to before.
+func (eng *GameEngine) bindPlayer(client *sockethub.Client, id entity.Id) {
+	eng.unbindClient(client)
+	eng.unbindPlayer(id)
+	eng.PlayersMap[client] = id
+	eng.playerClients[id] = client
+	client.Join(eng.playersRoom())
+}
+
+func (eng *GameEngine) unbindClient(client *sockethub.Client) (entity.Id, bool) {
+	id, ok := eng.PlayersMap[client]
+	if ok {
+		delete(eng.PlayersMap, client)
+		delete(eng.playerClients, id)
+		client.Leave(eng.playersRoom())
+	}
+	return id, ok
+}
+
+func (eng *GameEngine) unbindPlayer(id entity.Id) {
+	if client, ok := eng.playerClients[id]; ok {
+		delete(eng.PlayersMap, client)
+		delete(eng.playerClients, id)
+		client.Leave(eng.playersRoom())
+	}
+}
+
+// playersRoom is the hub room of the clients controlling a player, which the
+// engine's broadcasts go to. Rooms of a GameServer share its hub.
+func (eng *GameEngine) playersRoom() string {
+	if eng.Name == "" {
+		return "players"
+	}
+	return "room/" + eng.Name
+}
+
 func (eng *GameEngine) HandleMoveEvent(event *schemas.MoveEvent, client *sockethub.Client) {
 	pl, err := eng.Map.Players.Update(eng.PlayersMap[client], event.NewX, event.NewY)
 	if err != nil {
@@ -128,19 +238,22 @@ func (eng *GameEngine) HandleMoveEvent(event *schemas.MoveEvent, client *socketh
 		log.Println(err)
 		return
 	}
-	if err := client.Emit(data.Bytes()); err != nil {
-		log.Println(err)
-	}
+	eng.outbox.Push(client, data.Bytes())
 }
 
 func (eng *GameEngine) SendPong(data []byte, client *sockethub.Client) {
-	pingData := make(map[string]interface{})
-	if err := schemas.PingPongSchema.Decode(data, &pingData); err != nil {
+	sendPong(data, client)
+}
+
+// sendPong answers a ping whether or not the client plays in a room.
+func sendPong(data []byte, client *sockethub.Client) {
+	pingEvent := &schemas.PingPongEvent{}
+	if err := schemas.PingPongSchema.Decode(data, pingEvent); err != nil {
 		log.Println("PingPongSchema.Decode(): ", err)
 		return
 	}
-	pongEvent := map[string]interface{}{"event": constants.Pong, "timestamp": pingData["timestamp"]}
-	if data, err := schemas.PingPongSchema.Encode(&pongEvent); err != nil {
+	pongEvent := &schemas.PingPongEvent{Event: constants.Pong, Timestamp: pingEvent.Timestamp}
+	if data, err := schemas.PingPongSchema.Encode(pongEvent); err != nil {
 		log.Println("PingPongSchema.Encode(): ", err)
 	} else {
 		client.Emit(data.Bytes())
@@ -148,7 +261,15 @@ func (eng *GameEngine) SendPong(data []byte, client *sockethub.Client) {
 }
 
 func (eng *GameEngine) publishStats() {
-	for range time.Tick(time.Duration(2000) * time.Millisecond) {
+	ticker := time.NewTicker(time.Duration(2000) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-eng.quit:
+			return
+		}
+		eng.mu.Lock()
 		stats := eng.Map.GetStats()
 		statsEvent := &schemas.PlayerStatsEvent{
 			Event:      constants.StatsUpdate,
@@ -159,36 +280,36 @@ func (eng *GameEngine) publishStats() {
 		} else {
 			eng.notifyAllPlayers(data.Bytes())
 		}
+		eng.mu.Unlock()
 	}
 }
 
 func (eng *GameEngine) notifyAllPlayers(data []byte) {
-	for client, _ := range eng.PlayersMap {
-		client.Emit(data)
-	}
+	eng.outbox.Broadcast(eng.Hub.InRoom(eng.playersRoom()), data)
 }
 
 func (eng *GameEngine) publishAdminStats() {
 	for {
 		var result = make(map[string]interface{})
+		eng.mu.Lock()
 		botsCount := eng.Map.Players.BotsCount()
 		stats := eng.Map.GetStats()
 
 		result["botsCount"] = botsCount
 		result["playersCount"] = eng.Map.Players.Len() - botsCount
 		result["topPlayers"] = stats
+		eng.mu.Unlock()
 		// TODO: fix later
 		//eng.Hub.Emit("stats", result, "admin")
-		time.Sleep(2 * time.Second)
+		select {
+		case <-time.After(2 * time.Second):
+		case <-eng.quit:
+			return
+		}
 	}
 }
 
-func (eng *GameEngine) notifyPlayer(pl *players.Player) error {
-	client, err := eng.PlayerReverseLookUp(pl.Id)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
+func (eng *GameEngine) notifyPlayer(pl *players.Player, client *sockethub.Client) error {
 	movedEvent := &schemas.MovedEvent{
 		Event:     constants.Moved,
 		X:         pl.X,
@@ -203,10 +324,7 @@ func (eng *GameEngine) notifyPlayer(pl *players.Player) error {
 		log.Println(err)
 		return err
 	} else {
-		if err := client.Emit(data.Bytes()); err != nil {
-			pl.IsDead = true
-			delete(eng.PlayersMap, client)
-		}
+		eng.outbox.Push(client, data.Bytes())
 	}
 	plrs := eng.Map.Players.Closest(pl, constants.NumPlayersResponse)
 	plUpdateEvent := &schemas.PlayersUpdatedEvent{
@@ -217,10 +335,7 @@ func (eng *GameEngine) notifyPlayer(pl *players.Player) error {
 		log.Println(err)
 		return err
 	} else {
-		if err := client.Emit(data.Bytes()); err != nil {
-			pl.IsDead = true
-			delete(eng.PlayersMap, client)
-		}
+		eng.outbox.Push(client, data.Bytes())
 	}
 	return nil
 }
@@ -231,62 +346,113 @@ func (eng *GameEngine) MakeMove(pl *players.Player) {
 	pl.UpdateDirection(closestFood.X, closestFood.Y)
 }
 
+// Run serves the engine's own hub and ticks until Stop is called. Engines
+// belonging to a GameServer are started by the server instead.
 func (eng *GameEngine) Run() {
-
-	eng.Hub.OnMessage(func(data []byte, client *sockethub.Client) {
-		event := &schemas.GenericEvent{}
-		if err := schemas.GenericSchema.Decode(data, event); err != nil {
-			log.Println("GenericSchema.Decode(): ", err)
-			return
-		}
-		switch event.Event {
-		case constants.Move:
-			moveEvent := &schemas.MoveEvent{}
-			if err := schemas.MoveSchema.Decode(data, moveEvent); err != nil {
-				log.Println("MoveSchema.Decode(): ", err)
-				return
-			}
-			eng.HandleMoveEvent(moveEvent, client)
-		case constants.Start:
-			var startEvent = make(map[string]interface{})
-			if err := schemas.StartSchema.Decode(data, &startEvent); err != nil {
-				log.Println("StartSchema.Decode(): ", err)
-				return
-			}
-			nickname := startEvent["nickname"].(string)
-			player := eng.Map.CreatePlayer(nickname, false)
-			eng.PlayersMap[client] = player.Id
-			startedEvent := &schemas.StartedEvent{
-				Event: constants.Started,
-				Player: &schemas.StartedEventPlayer{
-					X:      player.X,
-					Y:      player.Y,
-					Weight: player.Weight,
-					Color:  player.Color,
-					Points: castPoints(player.Shell.Points),
-				},
-				Spikes: castSpikes(eng.Map.Spikes.Spikes),
-				Food:   castFood(eng.Map.Food.Food),
-			}
-			if data, err := schemas.StartedSchema.Encode(startedEvent); err != nil {
-				log.Println("StartedSchema.Encode(): ", err)
-				return
-			} else {
-				if err := client.Emit(data.Bytes()); err != nil {
-					log.Println(err)
-				}
-				client.Join(fmt.Sprintf("player/%d", player.Id))
-			}
-		case constants.Ping:
-			eng.SendPong(data, client)
+	eng.Hub.OnDisconnect(func(client *sockethub.Client, reason sockethub.DisconnectReason) {
+		log.Println("client disconnected: ", reason)
+		// the hub keeps running after Stop, nobody reads disconnected then
+		select {
+		case eng.disconnected <- client:
+		case <-eng.quit:
 		}
 	})
-	go eng.publishStats()
+	eng.Hub.OnMessage(eng.handleMessage)
 	go eng.Hub.Run()
-	go eng.Map.PopulateSpikes()
+	eng.run()
+}
+
+// run starts the stats publishers and runs the tick loop until Stop.
+func (eng *GameEngine) run() {
+	go eng.publishStats()
+	go func() {
+		eng.mu.Lock()
+		eng.Map.PopulateSpikes()
+		eng.mu.Unlock()
+	}()
 	go eng.publishAdminStats()
-	for range time.Tick(eng.runEvery) {
-		eng.Loop()
+	ticker := time.NewTicker(eng.runEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			eng.Loop()
+		case <-eng.quit:
+			return
+		}
+	}
+}
+
+// Stop ends the tick loop and the stats publishers, the hub and its clients
+// are left alone.
+func (eng *GameEngine) Stop() {
+	eng.stopOnce.Do(func() {
+		close(eng.quit)
+	})
+}
+
+func (eng *GameEngine) handleMessage(data []byte, client *sockethub.Client) {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+	event := &schemas.GenericEvent{}
+	if err := schemas.GenericSchema.Decode(data, event); err != nil {
+		log.Println("GenericSchema.Decode(): ", err)
+		return
+	}
+	switch event.Event {
+	case constants.Move:
+		moveEvent := &schemas.MoveEvent{}
+		if err := schemas.MoveSchema.Decode(data, moveEvent); err != nil {
+			log.Println("MoveSchema.Decode(): ", err)
+			return
+		}
+		eng.HandleMoveEvent(moveEvent, client)
+	case constants.Start:
+		var startEvent = make(map[string]interface{})
+		if err := schemas.StartSchema.Decode(data, &startEvent); err != nil {
+			log.Println("StartSchema.Decode(): ", err)
+			return
+		}
+		nickname := startEvent["nickname"].(string)
+		// authenticated players play under the name their token was issued
+		// for, so that nobody can take it
+		if identity := client.Identity(); identity != nil && identity.Subject != "" {
+			nickname = identity.Subject
+		}
+		if id, ok := eng.PlayersMap[client]; ok {
+			eng.removePlayer(id)
+		}
+		player := eng.Map.CreatePlayer(nickname, false)
+		eng.bindPlayer(client, player.Id)
+		eng.sendStarted(client, player, eng.newSession(client, player.Id))
+	case constants.Resume:
+		eng.handleResume(data, client)
+	case constants.Ping:
+		eng.SendPong(data, client)
+	}
+}
+
+func (eng *GameEngine) sendStarted(client *sockethub.Client, player *players.Player, s *session) {
+	startedEvent := &schemas.StartedEvent{
+		Event: constants.Started,
+		Player: &schemas.StartedEventPlayer{
+			X:      player.X,
+			Y:      player.Y,
+			Weight: player.Weight,
+			Color:  player.Color,
+			Points: castPoints(player.Shell.Points),
+		},
+		Spikes:  castSpikes(eng.Map.Spikes.Spikes),
+		Food:    castFood(eng.Map.Food.Food),
+		Session: s.token,
+	}
+	data, err := schemas.StartedSchema.Encode(startedEvent)
+	if err != nil {
+		log.Println("StartedSchema.Encode(): ", err)
+		return
+	}
+	if err := client.Emit(data.Bytes()); err != nil {
+		log.Println(err)
 	}
 }
 
@@ -311,32 +477,37 @@ func (eng *GameEngine) removeDeadPlayers() {
 	ripEvent := map[string]interface{}{"event": constants.Rip}
 	deadPlayers := eng.Map.RemoveDeadPlayers()
 	for _, pl := range deadPlayers {
+		eng.endSession(pl.Id)
 		client, err := eng.PlayerReverseLookUp(pl.Id)
 		if err != nil {
-			log.Println(err)
 			continue
 		}
+		eng.unbindPlayer(pl.Id)
+		// nothing may follow the Rip, not even the updates of this tick
+		eng.outbox.Drop(client)
 		if data, err := schemas.GenericSchema.Encode(&ripEvent); err != nil {
 			log.Println(err)
-		} else {
-			if err := client.Emit(data.Bytes()); err != nil {
-				log.Println(err)
-			}
+		} else if err := client.Emit(data.Bytes()); err != nil {
+			log.Println(err)
 		}
 	}
 }
 
 func (eng *GameEngine) removeEatableFood() {
 	eatenFood := eng.Map.RemoveEatableFood()
-	for _, f := range eatenFood {
-		event := &schemas.FoodEatenEvent{
-			Event: constants.FoodEaten,
-			Id:    f.Id,
-		}
-		if data, err := schemas.FoodEatenSchema.Encode(event); err == nil {
-			eng.notifyAllPlayers(data.Bytes())
-		} else {
-			log.Println("FoodEatenSchema.Decode()", err)
-		}
+	if len(eatenFood) == 0 {
+		return
+	}
+	event := &schemas.FoodEatenEvent{
+		Event: constants.FoodEaten,
+		Ids:   make([]entity.Id, len(eatenFood)),
+	}
+	for i, f := range eatenFood {
+		event.Ids[i] = f.Id
+	}
+	if data, err := schemas.FoodEatenSchema.Encode(event); err == nil {
+		eng.notifyAllPlayers(data.Bytes())
+	} else {
+		log.Println("FoodEatenSchema.Encode()", err)
 	}
 }
@@ -1,5 +1,366 @@
 package gamengine
 
+import (
+	"errors"
+	"fmt"
+	"github.com/diyor28/not-agar/src/gamengine/constants"
+	"github.com/diyor28/not-agar/src/gamengine/schemas"
+	"github.com/diyor28/not-agar/src/sockethub"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrRoomFull = errors.New("room is full")
+
+var ErrTooManyRooms = errors.New("too many rooms")
+
+// GlobalRoom holds the clients of every room, it is the room to share with
+// other servers through the hub's broker, see Announce. Game events stay
+// within their server.
+const GlobalRoom = "global"
+
+// GameServer runs a GameEngine per room behind a single hub. Clients are
+// placed in a room when they start playing, either the one they name or any
+// public room with a free slot, and rooms are created on demand and torn
+// down once nobody plays in them.
 type GameServer struct {
-	gameMaps []GameEngine
+	Hub *sockethub.Hub
+	// MaxPlayers caps the clients of each room, bots aside. Players waiting
+	// for their client to resume keep their slot.
+	MaxPlayers int
+	// MaxRooms caps the rooms running at once, clients that would open
+	// another one are turned away. Zero lifts the cap.
+	MaxRooms int
+	// IdleTimeout is how long an empty room is kept before being torn down.
+	IdleTimeout time.Duration
+	// Configure, when set, adjusts every engine before its tick loop starts.
+	Configure func(eng *GameEngine)
+	framerate int
+	mu        sync.Mutex
+	rooms     map[string]*room
+	clients   map[*sockethub.Client]*room
+	// lastRoom numbers the public rooms.
+	lastRoom int
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+type room struct {
+	engine *GameEngine
+	// public rooms are created by the server and receive the clients that
+	// don't name a room.
+	public     bool
+	clients    int
+	emptySince time.Time
+}
+
+// RoomStats describes a room of a GameServer.
+type RoomStats struct {
+	Name    string
+	Public  bool
+	Clients int
+	// Players counts the players of the room, bots aside, including the
+	// ones waiting for their client to resume.
+	Players int
+}
+
+func NewGameServer(framerate int) *GameServer {
+	return NewGameServerWithConfig(framerate, HubConfig())
+}
+
+func NewGameServerWithConfig(framerate int, config sockethub.Config) *GameServer {
+	return &GameServer{
+		Hub:         sockethub.NewHubWithConfig(config),
+		MaxPlayers:  constants.MaxPlayers,
+		MaxRooms:    constants.MaxRooms,
+		IdleTimeout: 30 * time.Second,
+		framerate:   framerate,
+		rooms:       make(map[string]*room),
+		clients:     make(map[*sockethub.Client]*room),
+		quit:        make(chan struct{}),
+	}
+}
+
+// Run serves the hub and tears down idle rooms until Stop is called.
+func (s *GameServer) Run() {
+	s.Hub.OnDisconnect(func(client *sockethub.Client, reason sockethub.DisconnectReason) {
+		log.Println("client disconnected: ", reason)
+		s.disconnect(client)
+	})
+	s.Hub.OnMessage(s.handleMessage)
+	go s.Hub.Run()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.removeIdleRooms()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// Stop stops the tick loop of every room, the hub and its clients are left
+// alone.
+func (s *GameServer) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.quit)
+		s.mu.Lock()
+		for name, r := range s.rooms {
+			r.engine.Stop()
+			delete(s.rooms, name)
+		}
+		s.mu.Unlock()
+	})
+}
+
+// Rooms returns the rooms currently running, sorted by name.
+func (s *GameServer) Rooms() []RoomStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]RoomStats, 0, len(s.rooms))
+	for name, r := range s.rooms {
+		stats = append(stats, RoomStats{
+			Name:    name,
+			Public:  r.public,
+			Clients: r.clients,
+			Players: r.engine.humanPlayers(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+// Announce sends message to the players of every room, and to the ones of
+// the other servers when the hub shares GlobalRoom through a broker.
+func (s *GameServer) Announce(message string) error {
+	data, err := schemas.AnnouncementSchema.Encode(&schemas.AnnouncementEvent{Event: constants.Announcement, Message: message})
+	if err != nil {
+		return err
+	}
+	s.Hub.EmitTo(data.Bytes(), GlobalRoom)
+	return nil
+}
+
+func (s *GameServer) handleMessage(data []byte, client *sockethub.Client) {
+	event := &schemas.GenericEvent{}
+	if err := schemas.GenericSchema.Decode(data, event); err != nil {
+		log.Println("GenericSchema.Decode(): ", err)
+		return
+	}
+	switch event.Event {
+	case constants.Start:
+		var startEvent = make(map[string]interface{})
+		if err := schemas.StartSchema.Decode(data, &startEvent); err != nil {
+			log.Println("StartSchema.Decode(): ", err)
+			return
+		}
+		name, _ := startEvent["room"].(string)
+		r, err := s.assign(client, name)
+		if err != nil {
+			sendRoomFull(client)
+			return
+		}
+		r.engine.handleMessage(data, client)
+	case constants.Resume:
+		event := &schemas.ResumeEvent{}
+		if err := schemas.ResumeSchema.Decode(data, event); err != nil {
+			log.Println("ResumeSchema.Decode(): ", err)
+			sendResumeFailed(client)
+			return
+		}
+		key, ok := sessionKey(event.Session)
+		if !ok {
+			sendResumeFailed(client)
+			return
+		}
+		if !s.resumeSession(client, key, data) {
+			sendResumeFailed(client)
+		}
+	case constants.Ping:
+		sendPong(data, client)
+	default:
+		s.mu.Lock()
+		r, ok := s.clients[client]
+		s.mu.Unlock()
+		if ok {
+			r.engine.handleMessage(data, client)
+		}
+	}
+}
+
+// assign moves client to the room called name, or to a public room with a
+// free slot when name is empty. Clients starting again stay where they are.
+// It fails when the room is full or no room can be opened for client.
+func (s *GameServer) assign(client *sockethub.Client, name string) (*room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.clients[client]
+	if ok && (name == "" || name == current.engine.Name) {
+		return current, nil
+	}
+	var r *room
+	if name != "" {
+		r = s.rooms[name]
+		if r != nil && s.full(r) {
+			return nil, ErrRoomFull
+		}
+	} else {
+		r = s.freeRoom()
+	}
+	if r == nil && s.MaxRooms > 0 && len(s.rooms) >= s.MaxRooms {
+		return nil, ErrTooManyRooms
+	}
+	if ok {
+		s.leave(client, current)
+	}
+	if r == nil {
+		public := name == ""
+		if public {
+			name = s.nextRoomName()
+		}
+		r = s.newRoom(name, public)
+	}
+	s.join(client, r)
+	return r, nil
+}
+
+// resumeSession hands client the player of the session with token, in the
+// room holding it, and reports false when none does. The engine resumes the
+// player under s.mu and the client only takes the slot once it plays, so
+// that a session expiring meanwhile can't leave the room over MaxPlayers:
+// the engine answers ResumeFailed then.
+func (s *GameServer) resumeSession(client *sockethub.Client, token string, data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.rooms {
+		if !r.engine.hasSession(token) {
+			continue
+		}
+		current, ok := s.clients[client]
+		if ok && current != r {
+			s.leave(client, current)
+		}
+		r.engine.handleMessage(data, client)
+		if r.engine.plays(client) && current != r {
+			s.join(client, r)
+		}
+		return true
+	}
+	return false
+}
+
+// freeRoom returns the fullest public room with a free slot, so that players
+// meet rather than spread over many rooms, or nil when all are full.
+func (s *GameServer) freeRoom() *room {
+	var best *room
+	for _, r := range s.rooms {
+		if !r.public || s.full(r) {
+			continue
+		}
+		if best == nil || r.clients > best.clients {
+			best = r
+		}
+	}
+	return best
+}
+
+func (s *GameServer) full(r *room) bool {
+	return r.clients+r.engine.detachedPlayers() >= s.MaxPlayers
+}
+
+// nextRoomName skips the names clients have taken for their own rooms.
+func (s *GameServer) nextRoomName() string {
+	for {
+		s.lastRoom++
+		name := fmt.Sprintf("room-%d", s.lastRoom)
+		if _, ok := s.rooms[name]; !ok {
+			return name
+		}
+	}
+}
+
+func (s *GameServer) newRoom(name string, public bool) *room {
+	eng := newGameEngine(s.framerate, s.Hub)
+	eng.Name = name
+	if s.Configure != nil {
+		s.Configure(eng)
+	}
+	r := &room{engine: eng, public: public}
+	s.rooms[name] = r
+	go eng.run()
+	log.Println("room created: ", name)
+	return r
+}
+
+func (s *GameServer) join(client *sockethub.Client, r *room) {
+	client.Join(GlobalRoom)
+	s.clients[client] = r
+	r.clients++
+	r.emptySince = time.Time{}
+}
+
+func (s *GameServer) leave(client *sockethub.Client, r *room) {
+	delete(s.clients, client)
+	r.clients--
+	r.engine.leave(client)
+}
+
+// disconnect frees the slot of client once its player waits in the room for
+// the client to resume, under the lock assign checks the slots with.
+func (s *GameServer) disconnect(client *sockethub.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.clients[client]
+	if !ok {
+		return
+	}
+	r.engine.disconnect(client)
+	delete(s.clients, client)
+	r.clients--
+}
+
+// removeIdleRooms stops the rooms that have had neither clients nor players
+// for IdleTimeout.
+func (s *GameServer) removeIdleRooms() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for name, r := range s.rooms {
+		if r.clients > 0 || r.engine.humanPlayers() > 0 {
+			r.emptySince = time.Time{}
+			continue
+		}
+		if r.emptySince.IsZero() {
+			r.emptySince = now
+		}
+		if now.Sub(r.emptySince) >= s.IdleTimeout {
+			r.engine.Stop()
+			delete(s.rooms, name)
+			log.Println("room removed: ", name)
+		}
+	}
+}
+
+// humanPlayers counts the players of the engine that aren't bots.
+func (eng *GameEngine) humanPlayers() int {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+	return eng.Map.Players.Len() - eng.Map.Players.BotsCount()
+}
+
+func sendRoomFull(client *sockethub.Client) {
+	data, err := schemas.GenericSchema.Encode(&schemas.GenericEvent{Event: constants.RoomFull})
+	if err != nil {
+		log.Println("GenericSchema.Encode(): ", err)
+		return
+	}
+	if err := client.Emit(data.Bytes()); err != nil {
+		log.Println(err)
+	}
 }
@@ -0,0 +1,53 @@
+package gamengine
+
+import (
+	"github.com/diyor28/not-agar/src/gamengine/constants"
+	"github.com/diyor28/not-agar/src/sockethub"
+)
+
+// rateLimits leave headroom for browsers sending a Move per mouse event on
+// high refresh rate screens. Start creates a new player every time and
+// Resume guesses session tokens, so clients spamming them are disconnected.
+var rateLimits = map[byte]sockethub.RateLimit{
+	byte(constants.Move):   {Rate: 240, Burst: 120, Action: sockethub.RateLimitDrop},
+	byte(constants.Start):  {Rate: 0.5, Burst: 3, Action: sockethub.RateLimitDisconnect},
+	byte(constants.Resume): {Rate: 0.5, Burst: 3, Action: sockethub.RateLimitDisconnect},
+	byte(constants.Ping):   {Rate: 2, Burst: 10, Action: sockethub.RateLimitDrop},
+}
+
+// unknownEventLimit disconnects clients flooding events the engine does not
+// handle, no honest client sends them. They aren't banned since behind a
+// proxy not listed in TrustedProxies every client shares its IP.
+var unknownEventLimit = sockethub.RateLimit{Rate: 1, Burst: 10, Action: sockethub.RateLimitDisconnect}
+
+// compressedEvents always compresses the snapshots sent when a player starts,
+// while pongs and deaths never are since deflating a few bytes only makes
+// them larger. The policy sees the frames as written, so only the events
+// emitted on their own are listed: the tick updates and broadcasts go out
+// in batches, which depend on their size.
+var compressedEvents = map[byte]bool{
+	byte(constants.Started): true,
+	byte(constants.Pong):    false,
+	byte(constants.Rip):     false,
+}
+
+// priorities let control events overtake the updates queued for congested
+// clients, so that pings don't measure queueing. Started and Rip stay behind
+// the updates queued before them: the state Started carries already includes
+// them, and nothing may follow a Rip.
+var priorities = map[byte]sockethub.Priority{
+	byte(constants.Pong):         sockethub.PriorityHigh,
+	byte(constants.ResumeFailed): sockethub.PriorityHigh,
+	byte(constants.RoomFull):     sockethub.PriorityHigh,
+}
+
+// HubConfig returns the hub configuration the game relies on, servers adjust
+// the transport settings on top of it.
+func HubConfig() sockethub.Config {
+	config := sockethub.DefaultConfig()
+	config.RateLimits = rateLimits
+	config.DefaultRateLimit = &unknownEventLimit
+	config.Compression = sockethub.CompressionPolicy{MinSize: 512, Events: compressedEvents}
+	config.Priorities = priorities
+	return config
+}
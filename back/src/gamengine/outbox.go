@@ -0,0 +1,150 @@
+package gamengine
+
+import (
+	"github.com/diyor28/not-agar/src/gamengine/schemas"
+	"github.com/diyor28/not-agar/src/sockethub"
+	"sync"
+)
+
+// Outbox collects the events produced for every client during a tick so that
+// they are sent as a single frame when the tick ends. Events sent to many
+// clients are kept apart, batched together when they go to the same clients
+// and framed once for all of them.
+type Outbox struct {
+	mu         sync.Mutex
+	messages   map[*sockethub.Client][][]byte
+	broadcasts []*broadcast
+}
+
+type broadcast struct {
+	clients  []*sockethub.Client
+	members  map[*sockethub.Client]struct{}
+	messages [][]byte
+}
+
+func newBroadcast(clients []*sockethub.Client) *broadcast {
+	members := make(map[*sockethub.Client]struct{}, len(clients))
+	for _, client := range clients {
+		members[client] = struct{}{}
+	}
+	return &broadcast{clients: clients, members: members}
+}
+
+// sends reports whether b goes to exactly clients, in any order.
+func (b *broadcast) sends(clients []*sockethub.Client) bool {
+	if len(clients) != len(b.members) {
+		return false
+	}
+	for _, client := range clients {
+		if _, ok := b.members[client]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func NewOutbox() *Outbox {
+	return &Outbox{messages: make(map[*sockethub.Client][][]byte)}
+}
+
+func (o *Outbox) Push(client *sockethub.Client, data []byte) {
+	o.mu.Lock()
+	o.messages[client] = append(o.messages[client], data)
+	o.mu.Unlock()
+}
+
+// Broadcast queues data for every one of clients, it is sent after their
+// own events.
+func (o *Outbox) Broadcast(clients []*sockethub.Client, data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, b := range o.broadcasts {
+		if b.sends(clients) {
+			b.messages = append(b.messages, data)
+			return
+		}
+	}
+	b := newBroadcast(clients)
+	b.messages = append(b.messages, data)
+	o.broadcasts = append(o.broadcasts, b)
+}
+
+// Drop discards the events queued for client, including its share of the
+// broadcasts, for clients that must not receive anything more.
+func (o *Outbox) Drop(client *sockethub.Client) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.messages, client)
+	for _, b := range o.broadcasts {
+		if _, ok := b.members[client]; !ok {
+			continue
+		}
+		delete(b.members, client)
+		clients := make([]*sockethub.Client, 0, len(b.members))
+		for _, c := range b.clients {
+			if c != client {
+				clients = append(clients, c)
+			}
+		}
+		b.clients = clients
+	}
+}
+
+// Flush sends the queued events of every client, wrapping them in a Batch
+// event when there is more than one, and returns the clients that could not
+// be written to.
+func (o *Outbox) Flush() map[*sockethub.Client]error {
+	o.mu.Lock()
+	messages := o.messages
+	o.messages = make(map[*sockethub.Client][][]byte, len(messages))
+	broadcasts := o.broadcasts
+	o.broadcasts = nil
+	o.mu.Unlock()
+
+	failed := make(map[*sockethub.Client]error)
+	for client, queued := range messages {
+		data, err := batch(queued)
+		if err != nil {
+			failed[client] = err
+			continue
+		}
+		if err := client.EmitBatch(data, queued); err != nil {
+			failed[client] = err
+		}
+	}
+	for _, b := range broadcasts {
+		if len(b.clients) == 0 {
+			continue
+		}
+		data, err := batch(b.messages)
+		if err != nil {
+			for _, client := range b.clients {
+				failed[client] = err
+			}
+			continue
+		}
+		message := sockethub.NewBatchMessage(data, b.messages)
+		for _, client := range b.clients {
+			if _, ok := failed[client]; ok {
+				continue
+			}
+			if err := client.EmitPrepared(message); err != nil {
+				failed[client] = err
+			}
+		}
+	}
+	return failed
+}
+
+// batch wraps messages in a Batch event when there is more than one. The
+// messages are handed to the hub along with it, for its traffic stats.
+func batch(messages [][]byte) ([]byte, error) {
+	if len(messages) == 1 {
+		return messages[0], nil
+	}
+	writer, err := schemas.EncodeBatch(messages)
+	if err != nil {
+		return nil, err
+	}
+	return writer.Bytes(), nil
+}
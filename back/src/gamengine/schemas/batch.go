@@ -0,0 +1,33 @@
+package schemas
+
+import (
+	"errors"
+	"fmt"
+	"github.com/diyor28/not-agar/src/csbin"
+	"github.com/diyor28/not-agar/src/csbin/bytesIO"
+	"github.com/diyor28/not-agar/src/gamengine/constants"
+)
+
+// EncodeBatch wraps already encoded events into a single Batch event so they
+// can be sent as one websocket frame.
+func EncodeBatch(messages [][]byte) (*bytesIO.BytesWriter, error) {
+	writer := bytesIO.NewWriter()
+	writer.WriteUint8(uint8(constants.Batch), "event")
+	if err := csbin.EncodeBatch(messages, writer); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// DecodeBatch returns the events wrapped by EncodeBatch.
+func DecodeBatch(data []byte) ([][]byte, error) {
+	reader := bytesIO.NewReader(data)
+	event, err := reader.ReadUint8()
+	if err != nil {
+		return nil, err
+	}
+	if constants.GameEvent(event) != constants.Batch {
+		return nil, errors.New(fmt.Sprintf("expected event %d, got %d", constants.Batch, event))
+	}
+	return csbin.DecodeBatch(reader)
+}
@@ -3,6 +3,7 @@ package schemas
 import (
 	"github.com/diyor28/not-agar/src/csbin"
 	"reflect"
+	"time"
 )
 
 var playerField = csbin.NewField("player", reflect.Struct).SubFields(
@@ -32,11 +33,12 @@ var GenericSchema = csbin.New(
 )
 
 var PingPongSchema = GenericSchema.Extends(
-	csbin.NewField("timestamp", reflect.Uint64),
+	csbin.NewTimeField("timestamp", time.Millisecond),
 )
 
 var StartSchema = GenericSchema.Extends(
 	csbin.NewField("nickname", reflect.String).MaxLen(255),
+	csbin.NewField("room", reflect.String).MaxLen(64),
 )
 
 var StartedSchema = GenericSchema.Extends(
@@ -52,6 +54,15 @@ var StartedSchema = GenericSchema.Extends(
 	),
 	csbin.NewField("spikes", reflect.Slice).MaxLen(255).SubType(spikeField),
 	csbin.NewField("food", reflect.Slice).MaxLen(10000).SubType(foodField),
+	csbin.NewUUIDField("session"),
+)
+
+var ResumeSchema = GenericSchema.Extends(
+	csbin.NewUUIDField("session"),
+)
+
+var AnnouncementSchema = GenericSchema.Extends(
+	csbin.NewField("message", reflect.String).MaxLen(255),
 )
 
 var MoveSchema = GenericSchema.Extends(
@@ -91,7 +102,7 @@ var FoodCreatedSchema = GenericSchema.Extends(
 )
 
 var FoodEatenSchema = GenericSchema.Extends(
-	csbin.NewField("id", reflect.Uint32),
+	csbin.NewField("ids", reflect.Slice).MaxLen(10000).SubType(csbin.NewField("id", reflect.Uint32)),
 )
 
 var PlayersUpdatedSchema = GenericSchema.Extends(
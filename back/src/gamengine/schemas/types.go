@@ -3,6 +3,8 @@ package schemas
 import (
 	"github.com/diyor28/not-agar/src/gamengine/constants"
 	"github.com/diyor28/not-agar/src/gamengine/map/entity"
+	"github.com/frankenbeanies/uuid4"
+	"time"
 )
 
 type Color [3]uint8
@@ -38,6 +40,11 @@ type GenericEvent struct {
 	Event constants.GameEvent
 }
 
+type PingPongEvent struct {
+	Event     constants.GameEvent
+	Timestamp time.Time
+}
+
 type MovedEvent struct {
 	Event     constants.GameEvent
 	X         float32
@@ -58,10 +65,22 @@ type StartedEventPlayer struct {
 }
 
 type StartedEvent struct {
-	Event  constants.GameEvent
-	Player *StartedEventPlayer
-	Spikes []*Spike
-	Food   []*Food
+	Event   constants.GameEvent
+	Player  *StartedEventPlayer
+	Spikes  []*Spike
+	Food    []*Food
+	Session uuid4.UUID4
+}
+
+type ResumeEvent struct {
+	Event   constants.GameEvent
+	Session uuid4.UUID4
+}
+
+// AnnouncementEvent is a message for the players of every room.
+type AnnouncementEvent struct {
+	Event   constants.GameEvent
+	Message string
 }
 
 type MoveEvent struct {
@@ -80,9 +99,10 @@ type PlayerStatsEvent struct {
 	TopPlayers []*PlayerStat
 }
 
+// FoodEatenEvent lists all the food eaten during a tick.
 type FoodEatenEvent struct {
 	Event constants.GameEvent
-	Id    entity.Id
+	Ids   []entity.Id
 }
 
 type PlayersUpdatedEvent struct {
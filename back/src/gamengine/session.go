@@ -0,0 +1,185 @@
+package gamengine
+
+import (
+	"github.com/diyor28/not-agar/src/gamengine/constants"
+	"github.com/diyor28/not-agar/src/gamengine/map/entity"
+	"github.com/diyor28/not-agar/src/gamengine/map/players"
+	"github.com/diyor28/not-agar/src/gamengine/schemas"
+	"github.com/diyor28/not-agar/src/sockethub"
+	"github.com/frankenbeanies/uuid4"
+	"log"
+	"time"
+)
+
+// session lets a client that lost its connection take its player back by
+// sending the token it received in Started.
+type session struct {
+	token    uuid4.UUID4
+	playerId entity.Id
+	// client is nil while the player waits for its client to resume.
+	client     *sockethub.Client
+	detachedAt time.Time
+}
+
+func (eng *GameEngine) newSession(client *sockethub.Client, playerId entity.Id) *session {
+	s := &session{token: uuid4.New(), playerId: playerId, client: client}
+	eng.sessions[s.token.String()] = s
+	eng.playerSessions[playerId] = s
+	return s
+}
+
+// sessionKey returns the key of the session with token in sessions, ok is
+// false for the zero UUID4, whose String panics.
+func sessionKey(token uuid4.UUID4) (key string, ok bool) {
+	for _, b := range token.Bytes() {
+		if b != 0 {
+			return token.String(), true
+		}
+	}
+	return "", false
+}
+
+func (eng *GameEngine) endSession(playerId entity.Id) {
+	if s, ok := eng.playerSessions[playerId]; ok {
+		delete(eng.sessions, s.token.String())
+		delete(eng.playerSessions, playerId)
+	}
+}
+
+// isFrozen reports whether pl is detached and should keep still rather than
+// drift until its client resumes.
+func (eng *GameEngine) isFrozen(pl *players.Player) bool {
+	if !eng.FreezeDetached {
+		return false
+	}
+	s, ok := eng.playerSessions[pl.Id]
+	return ok && s.client == nil
+}
+
+func (eng *GameEngine) removePlayer(playerId entity.Id) {
+	eng.Map.Players.RemoveById(playerId)
+	eng.unbindPlayer(playerId)
+	eng.endSession(playerId)
+}
+
+// detach unbinds client from its player, which then waits SessionGrace for
+// the client to resume before being removed.
+func (eng *GameEngine) detach(client *sockethub.Client) {
+	id, ok := eng.unbindClient(client)
+	if !ok {
+		return
+	}
+	s, ok := eng.playerSessions[id]
+	if !ok || eng.SessionGrace == 0 {
+		eng.removePlayer(id)
+		return
+	}
+	s.client = nil
+	s.detachedAt = time.Now()
+}
+
+func (eng *GameEngine) expireSessions() {
+	now := time.Now()
+	for _, s := range eng.sessions {
+		if s.client == nil && now.Sub(s.detachedAt) > eng.SessionGrace {
+			eng.removePlayer(s.playerId)
+		}
+	}
+}
+
+// hasSession reports whether the engine holds the session with token, for
+// the GameServer to route resuming clients back to their room.
+func (eng *GameEngine) hasSession(token string) bool {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+	_, ok := eng.sessions[token]
+	return ok
+}
+
+// detachedPlayers counts the players waiting for their client to resume.
+func (eng *GameEngine) detachedPlayers() int {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+	count := 0
+	for _, s := range eng.sessions {
+		if s.client == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// disconnect detaches client right away, for the GameServer to free the slot
+// of the client once its player holds it.
+func (eng *GameEngine) disconnect(client *sockethub.Client) {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+	eng.detach(client)
+}
+
+// plays reports whether client is bound to a player.
+func (eng *GameEngine) plays(client *sockethub.Client) bool {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+	_, ok := eng.PlayersMap[client]
+	return ok
+}
+
+// leave removes the player of a client moving to another room, unlike
+// detach it doesn't wait for the client to come back.
+func (eng *GameEngine) leave(client *sockethub.Client) {
+	eng.mu.Lock()
+	defer eng.mu.Unlock()
+	if id, ok := eng.unbindClient(client); ok {
+		eng.removePlayer(id)
+	}
+}
+
+func (eng *GameEngine) handleResume(data []byte, client *sockethub.Client) {
+	event := &schemas.ResumeEvent{}
+	if err := schemas.ResumeSchema.Decode(data, event); err != nil {
+		log.Println("ResumeSchema.Decode(): ", err)
+		sendResumeFailed(client)
+		return
+	}
+	key, ok := sessionKey(event.Session)
+	if !ok {
+		sendResumeFailed(client)
+		return
+	}
+	s, ok := eng.sessions[key]
+	if !ok {
+		sendResumeFailed(client)
+		return
+	}
+	pl, err := eng.Map.Players.Get(s.playerId)
+	if err != nil {
+		eng.endSession(s.playerId)
+		sendResumeFailed(client)
+		return
+	}
+	if s.client == client {
+		return
+	}
+	eng.detach(client)
+	if s.client != nil {
+		// the old connection has not been noticed as dead yet
+		eng.unbindClient(s.client)
+		s.client.CloseWithReason(sockethub.CloseNormalClosure, "session resumed elsewhere")
+	}
+	s.client = client
+	s.detachedAt = time.Time{}
+	eng.bindPlayer(client, pl.Id)
+	eng.sendStarted(client, pl, s)
+}
+
+func sendResumeFailed(client *sockethub.Client) {
+	data, err := schemas.GenericSchema.Encode(&schemas.GenericEvent{Event: constants.ResumeFailed})
+	if err != nil {
+		log.Println("GenericSchema.Encode(): ", err)
+		return
+	}
+	if err := client.Emit(data.Bytes()); err != nil {
+		log.Println(err)
+	}
+}
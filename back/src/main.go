@@ -1,49 +1,221 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"github.com/diyor28/not-agar/src/gamengine"
+	"github.com/diyor28/not-agar/src/gamengine/constants"
+	"github.com/diyor28/not-agar/src/sockethub"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 )
 
-var gameMap = gamengine.NewGameMap(50)
+var gameServer *gamengine.GameServer
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 2048,
+var streamAddr = flag.String("stream", "", "also accept length-prefixed connections, e.g. tcp:127.0.0.1:3101 or unix:/tmp/not-agar.sock, which must send a token first with -auth-secret")
+
+var authSecret = flag.String("auth-secret", "", "require tokens signed with this secret to connect")
+
+var issueToken = flag.String("issue-token", "", "print a token for this player name signed with -auth-secret and exit, browsers pass it as ?token= in the page URL")
+
+var tokenTTL = flag.Duration("token-ttl", 24*time.Hour, "how long tokens printed by -issue-token are valid")
+
+var brokerAddr = flag.String("broker", "", "share announcements with other servers through the broker at network:address")
+
+var serveBrokerAddr = flag.String("serve-broker", "", "only run a broker for other servers on network:address")
+
+var maxPlayers = flag.Int("max-players", constants.MaxPlayers, "players per room, bots aside, before new rooms are opened")
+
+var maxRooms = flag.Int("max-rooms", constants.MaxRooms, "rooms running at once before new players are turned away, 0 for no limit")
+
+var roomIdleTimeout = flag.Duration("room-idle-timeout", 30*time.Second, "how long rooms are kept once the last player has left")
+
+var compressionLogInterval = flag.Duration("compression-log-interval", 10*time.Minute, "how often to log how well each event compresses, 0 never does")
+
+var transport *sockethub.WebsocketTransport
+
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the query is left out since it may carry a token
+		log.Printf("%s %s %s", r.Method, r.URL.EscapedPath(), r.Proto)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticator builds the checks configured by the flags, it returns nil
+// when every connection is accepted. Origins are checked by the upgrader.
+func authenticator() sockethub.Authenticator {
+	if *authSecret == "" {
+		return nil
+	}
+	return sockethub.NewTokenAuth([]byte(*authSecret))
 }
 
-func playerWS(w http.ResponseWriter, r *http.Request) {
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-	ws, err := upgrader.Upgrade(w, r, nil)
+// announce sends the body of the request to every player, on every server
+// sharing the broker. It needs a token issued for "admin".
+func announce(w http.ResponseWriter, r *http.Request) {
+	auth := authenticator()
+	if auth == nil {
+		http.Error(w, "announcements need -auth-secret", http.StatusForbidden)
+		return
+	}
+	identity, err := auth.Authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if identity.Subject != "admin" {
+		http.Error(w, "only admin may announce", http.StatusForbidden)
+		return
+	}
+	message, err := ioutil.ReadAll(io.LimitReader(r.Body, 255))
 	if err != nil {
-		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	client := gameMap.Hub.AddConnection(ws)
-	client.Join("anonymous")
+	if err := gameServer.Announce(string(message)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s %s", r.Method, r.RequestURI, r.Proto)
-		next.ServeHTTP(w, r)
-	})
+// splitAddr splits addresses given as network:address.
+func splitAddr(addr string) (network string, address string) {
+	parts := strings.SplitN(addr, ":", 2)
+	if len(parts) != 2 {
+		log.Fatalf("invalid address %q, expected network:address", addr)
+	}
+	return parts[0], parts[1]
+}
+
+// serveStream accepts bots and tools on addr, given as network:address. They
+// must open their connection with a token when auth is enabled.
+func serveStream(addr string) {
+	streamTransport, err := sockethub.ListenStream(splitAddr(addr))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if auth := authenticator(); auth != nil {
+		streamTransport.SetAuthenticator(auth)
+	}
+	log.Println("Accepting stream connections on", streamTransport.Addr())
+	log.Println(gameServer.Hub.Serve(streamTransport))
+}
+
+// logCompression logs the compression stats of every event sent so far each
+// interval.
+func logCompression(interval time.Duration) {
+	for range time.Tick(interval) {
+		stats := gameServer.Hub.CompressionStats()
+		events := make([]int, 0, len(stats))
+		for event := range stats {
+			events = append(events, int(event))
+		}
+		sort.Ints(events)
+		for _, event := range events {
+			s := stats[byte(event)]
+			log.Printf("event %d: %d messages, %d compressed, %d bytes sent for %d (%.2f)",
+				event, s.Messages, s.Compressed, s.SentBytes, s.RawBytes, s.Ratio())
+		}
+	}
+}
+
+// serveBroker relays announcements between servers started with -broker
+// until the process is stopped.
+func serveBroker(addr string) {
+	server, err := sockethub.ListenBroker(splitAddr(addr))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Running broker on", server.Addr())
+	go func() {
+		log.Println(server.Serve())
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	log.Println("Shutting down:", <-signals)
+	server.Close()
 }
 
 func main() {
+	loadEnv()
+	flag.Parse()
+	if *issueToken != "" {
+		if *authSecret == "" {
+			log.Fatal("-issue-token needs -auth-secret")
+		}
+		fmt.Println(sockethub.NewTokenAuth([]byte(*authSecret)).Issue(*issueToken, *tokenTTL))
+		return
+	}
+	if *serveBrokerAddr != "" {
+		serveBroker(*serveBrokerAddr)
+		return
+	}
+	config := hubConfig()
+	gameServer = gamengine.NewGameServerWithConfig(50, config)
+	gameServer.MaxPlayers = *maxPlayers
+	gameServer.MaxRooms = *maxRooms
+	gameServer.IdleTimeout = *roomIdleTimeout
+	transport = sockethub.NewWebsocketTransport(config.Upgrader())
+	if *brokerAddr != "" {
+		broker, err := sockethub.DialBroker(splitAddr(*brokerAddr))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer broker.Close()
+		gameServer.Hub.UseBroker(broker, gamengine.GlobalRoom)
+	}
 	processes := 4
 	log.Println("Setting max processes:", processes)
 	runtime.GOMAXPROCS(processes)
-	go gameMap.Run()
+	go gameServer.Run()
+	if auth := authenticator(); auth != nil {
+		transport.SetAuthenticator(auth)
+	}
+	go func() {
+		log.Println(gameServer.Hub.Serve(transport))
+	}()
+	if *streamAddr != "" {
+		go serveStream(*streamAddr)
+	}
+	if *compressionLogInterval > 0 {
+		go logCompression(*compressionLogInterval)
+	}
 	router := mux.NewRouter().StrictSlash(true)
 	router.Use(loggingMiddleware)
-	router.HandleFunc("/player-ws", playerWS)
+	router.Handle("/player-ws", transport)
+	router.HandleFunc("/announce", announce).Methods(http.MethodPost)
 	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./static")))
-	log.Println("Listening on port 3100")
-	err := http.ListenAndServe(":3100", router)
-	log.Fatal(err)
+	server := &http.Server{Addr: ":3100", Handler: router}
+	go func() {
+		log.Println("Listening on port 3100")
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	log.Println("Shutting down:", <-signals)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := gameServer.Hub.ShutdownWithReason(ctx, sockethub.CloseServiceRestart, "server restarting"); err != nil {
+		log.Println("error while shutting down the hub:", err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("error while shutting down the server:", err)
+	}
+	gameServer.Stop()
 }
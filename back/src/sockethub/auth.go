@@ -0,0 +1,214 @@
+package sockethub
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identity is who an Authenticator found a connection to belong to.
+type Identity struct {
+	Subject string
+	// Method names the Authenticator that accepted the connection.
+	Method string
+}
+
+// Authenticator decides whether a websocket upgrade request is allowed
+// before the connection is upgraded. Rejections should be an *AuthError, any
+// other error is answered with 401.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// AuthError is a rejected connection, Status is the HTTP status the upgrade
+// request is answered with.
+type AuthError struct {
+	Status  int
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+var (
+	ErrMissingCredentials = &AuthError{Status: http.StatusUnauthorized, Message: "missing credentials"}
+	ErrInvalidCredentials = &AuthError{Status: http.StatusUnauthorized, Message: "invalid credentials"}
+	ErrExpiredToken       = &AuthError{Status: http.StatusUnauthorized, Message: "token expired"}
+	ErrOriginNotAllowed   = &AuthError{Status: http.StatusForbidden, Message: "origin not allowed"}
+)
+
+// authStatus returns the HTTP status a rejected request is answered with.
+func authStatus(err error) int {
+	if authErr, ok := err.(*AuthError); ok {
+		return authErr.Status
+	}
+	return http.StatusUnauthorized
+}
+
+// credential returns the bearer token of the Authorization header, or the
+// query parameter since browsers can't set headers on websocket requests.
+func credential(r *http.Request, param string) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return r.URL.Query().Get(param)
+}
+
+// APIKeyAuth accepts requests carrying one of Keys, either as a bearer token
+// or in the api_key query parameter. Keys maps each key to the subject of
+// its Identity.
+type APIKeyAuth struct {
+	Keys map[string]string
+}
+
+func (a *APIKeyAuth) Authenticate(r *http.Request) (*Identity, error) {
+	key := credential(r, "api_key")
+	if key == "" {
+		return nil, ErrMissingCredentials
+	}
+	for known, subject := range a.Keys {
+		if hmac.Equal([]byte(known), []byte(key)) {
+			return &Identity{Subject: subject, Method: "api_key"}, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// TokenAuth accepts tokens it signed with Issue, given either as a bearer
+// token or in the token query parameter. A token is the base64 encoded
+// subject and expiry followed by their HMAC-SHA256, so it can be checked
+// without keeping any state.
+type TokenAuth struct {
+	secret []byte
+}
+
+func NewTokenAuth(secret []byte) *TokenAuth {
+	return &TokenAuth{secret: secret}
+}
+
+// Issue returns a token for subject that is valid for ttl.
+func (a *TokenAuth) Issue(subject string, ttl time.Duration) string {
+	payload := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10) + ":" + subject
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(a.sign(encoded))
+}
+
+func (a *TokenAuth) sign(encoded string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// Verify returns the subject of token.
+func (a *TokenAuth) Verify(token string) (string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", ErrInvalidCredentials
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, a.sign(parts[0])) {
+		return "", ErrInvalidCredentials
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidCredentials
+	}
+	fields := strings.SplitN(string(payload), ":", 2)
+	if len(fields) != 2 {
+		return "", ErrInvalidCredentials
+	}
+	expires, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return "", ErrInvalidCredentials
+	}
+	if time.Now().Unix() > expires {
+		return "", ErrExpiredToken
+	}
+	return fields[1], nil
+}
+
+func (a *TokenAuth) Authenticate(r *http.Request) (*Identity, error) {
+	token := credential(r, "token")
+	if token == "" {
+		return nil, ErrMissingCredentials
+	}
+	subject, err := a.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{Subject: subject, Method: "token"}, nil
+}
+
+// OriginAuth accepts requests whose Origin header is one of Allowed, the
+// identity it returns is anonymous. Requests without an Origin, which don't
+// come from browsers, are accepted too.
+type OriginAuth struct {
+	Allowed []string
+}
+
+func (a *OriginAuth) Authenticate(r *http.Request) (*Identity, error) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return &Identity{Method: "origin"}, nil
+	}
+	for _, allowed := range a.Allowed {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return &Identity{Method: "origin"}, nil
+		}
+	}
+	return nil, ErrOriginNotAllowed
+}
+
+// AllOf accepts requests accepted by every authenticator, the identity is
+// the last one with a subject. It is meant for combining OriginAuth with a
+// credential check.
+func AllOf(authenticators ...Authenticator) Authenticator {
+	return allOf(authenticators)
+}
+
+type allOf []Authenticator
+
+func (a allOf) Authenticate(r *http.Request) (*Identity, error) {
+	identity := &Identity{}
+	for _, authenticator := range a {
+		id, err := authenticator.Authenticate(r)
+		if err != nil {
+			return nil, err
+		}
+		if identity.Subject == "" || id.Subject != "" {
+			identity = id
+		}
+	}
+	return identity, nil
+}
+
+// AnyOf accepts requests accepted by one of the authenticators, tried in
+// order. When all of them reject the request the first error is returned.
+func AnyOf(authenticators ...Authenticator) Authenticator {
+	return anyOf(authenticators)
+}
+
+type anyOf []Authenticator
+
+func (a anyOf) Authenticate(r *http.Request) (*Identity, error) {
+	var first error
+	for _, authenticator := range a {
+		identity, err := authenticator.Authenticate(r)
+		if err == nil {
+			return identity, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	if first == nil {
+		first = errors.New("no authenticator")
+	}
+	return nil, first
+}
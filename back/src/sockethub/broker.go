@@ -0,0 +1,140 @@
+package sockethub
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// BrokerMessage is a room broadcast shared between hubs.
+type BrokerMessage struct {
+	// Origin is the id of the hub that published the message, hubs ignore
+	// their own messages since they have already delivered them.
+	Origin string
+	Rooms  []string
+	Data   []byte
+}
+
+// Broker carries room broadcasts between hubs, typically in different
+// processes, so that each delivers them to the clients it owns. See
+// Hub.UseBroker.
+type Broker interface {
+	Publish(message BrokerMessage) error
+	// Subscribe registers handler for every message published from now on,
+	// the publisher's own messages included. Handlers must not block.
+	Subscribe(handler func(message BrokerMessage))
+	Close() error
+}
+
+var (
+	ErrBrokerClosed  = errors.New("broker is closed")
+	errBrokerMessage = errors.New("malformed broker message")
+)
+
+// encodeBrokerMessage writes the origin and every room prefixed with their
+// uint16 length, after the uint16 room count, followed by the data.
+func encodeBrokerMessage(message BrokerMessage) ([]byte, error) {
+	size := 4 + len(message.Origin) + len(message.Data)
+	for _, room := range message.Rooms {
+		size += 2 + len(room)
+	}
+	data := make([]byte, 0, size)
+	var err error
+	if data, err = appendBrokerString(data, message.Origin); err != nil {
+		return nil, err
+	}
+	if len(message.Rooms) > 0xffff {
+		return nil, errors.New("too many rooms in broker message")
+	}
+	data = append(data, 0, 0)
+	binary.BigEndian.PutUint16(data[len(data)-2:], uint16(len(message.Rooms)))
+	for _, room := range message.Rooms {
+		if data, err = appendBrokerString(data, room); err != nil {
+			return nil, err
+		}
+	}
+	return append(data, message.Data...), nil
+}
+
+func appendBrokerString(data []byte, s string) ([]byte, error) {
+	if len(s) > 0xffff {
+		return nil, errors.New("string too long for broker message")
+	}
+	data = append(data, 0, 0)
+	binary.BigEndian.PutUint16(data[len(data)-2:], uint16(len(s)))
+	return append(data, s...), nil
+}
+
+func decodeBrokerMessage(data []byte) (BrokerMessage, error) {
+	var message BrokerMessage
+	readUint16 := func() (int, bool) {
+		if len(data) < 2 {
+			return 0, false
+		}
+		n := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		return n, true
+	}
+	readString := func() (string, bool) {
+		n, ok := readUint16()
+		if !ok || len(data) < n {
+			return "", false
+		}
+		s := string(data[:n])
+		data = data[n:]
+		return s, true
+	}
+	var ok bool
+	if message.Origin, ok = readString(); !ok {
+		return message, errBrokerMessage
+	}
+	count, ok := readUint16()
+	if !ok {
+		return message, errBrokerMessage
+	}
+	message.Rooms = make([]string, count)
+	for i := range message.Rooms {
+		if message.Rooms[i], ok = readString(); !ok {
+			return message, errBrokerMessage
+		}
+	}
+	message.Data = data
+	return message, nil
+}
+
+// MemoryBroker connects hubs running in the same process, mostly for tests.
+type MemoryBroker struct {
+	mu       sync.RWMutex
+	handlers []func(message BrokerMessage)
+	closed   bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+// Publish hands message to every handler before returning.
+func (b *MemoryBroker) Publish(message BrokerMessage) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrBrokerClosed
+	}
+	for _, handler := range b.handlers {
+		handler(message)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(handler func(message BrokerMessage)) {
+	b.mu.Lock()
+	b.handlers = append(b.handlers, handler)
+	b.mu.Unlock()
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	return nil
+}
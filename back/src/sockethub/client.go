@@ -1,101 +1,348 @@
 package sockethub
 
 import (
-	"errors"
-	"github.com/gorilla/websocket"
+	"io"
 	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func remove(s []string, i int) []string {
-	s[i] = s[len(s)-1]
-	return s[:len(s)-1]
-}
-
+// Client is safe for concurrent use, it can be emitted to, closed and moved
+// between rooms from any goroutine.
 type Client struct {
-	IsClosed bool
-	channels []string
-	socket   *websocket.Conn
-	hub      *Hub
-	read     chan []byte
-	send     chan []byte
+	// lastActive is the UnixNano time of the last message read from the client,
+	// kept first so that it stays 64-bit aligned for atomic access.
+	lastActive int64
+	// rtt is also accessed atomically, so it follows lastActive.
+	rtt rtt
+
+	// id is assigned when the client is added and never changes.
+	id     string
+	socket Conn
+	hub    *Hub
+	// host is the IP the client is banned by, see Config.TrustedProxies.
+	host string
+	// identity is nil for connections that were not authenticated.
+	identity    *Identity
+	connectedAt time.Time
+	traffic     *traffic
+	queue       *sendQueue
+	inbox       *inbox
+	// limiter is nil when the hub has no rate limits.
+	limiter *rateLimiter
+	// done is closed by Close.
+	done chan struct{}
+
+	// rooms is guarded by the hub's room index.
+	rooms map[string]struct{}
+
+	closed    int32
+	closeOnce sync.Once
+	// reason holds the DisconnectReason plus one, zero until the first cause
+	// of the disconnect is known.
+	reason int32
 }
 
 func (conn *Client) writer() {
-	defer func() {
-		if conn.IsClosed {
-			return
-		}
-		err := conn.socket.Close()
-		if err != nil {
-			log.Println("error while closing: ", err)
+	config := conn.hub.config
+	var heartbeat <-chan time.Time
+	if interval := config.heartbeatInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	defer conn.hub.wg.Done()
+	defer conn.Close()
+	for {
+		select {
+		case <-conn.queue.ready:
+			messages, closed, farewell := conn.queue.take()
+			for _, message := range messages {
+				if err := conn.write(message); err != nil {
+					log.Println(err)
+					conn.setReason(ReasonWriteError)
+					return
+				}
+				conn.traffic.sent(message.data, message.events)
+			}
+			if closed {
+				if farewell != nil {
+					conn.writeClose(farewell)
+				}
+				return
+			}
+		case <-heartbeat:
+			if conn.isIdle() {
+				log.Println("disconnecting idle client: ", conn.socket.RemoteAddr())
+				conn.setReason(ReasonTimeout)
+				return
+			}
+			if config.PingInterval == 0 {
+				continue
+			}
+			conn.rtt.ping(time.Now())
+			if err := conn.writePing(); err != nil {
+				log.Println(err)
+				conn.setReason(ReasonWriteError)
+				return
+			}
 		}
-	}()
-	for message := range conn.send {
-		if conn.IsClosed {
-			break
+	}
+}
+
+func (conn *Client) write(message outMessage) error {
+	if err := conn.extendWriteDeadline(); err != nil {
+		return err
+	}
+	compressed := false
+	socket, ok := conn.socket.(compressor)
+	negotiated := ok && socket.Compressing()
+	if negotiated {
+		compressed = conn.hub.config.Compression.compress(message.data)
+		socket.EnableWriteCompression(compressed)
+	}
+	if err := conn.writeMessage(message); err != nil {
+		return err
+	}
+	if negotiated {
+		sent := len(message.data)
+		if compressed {
+			sent = message.compressedSize(conn.hub.config.Compression.Level)
 		}
-		if err := conn.socket.WriteMessage(websocket.BinaryMessage, message); err != nil {
-			log.Println(err)
-			break
+		conn.hub.compression.record(message.data, sent, compressed)
+	}
+	return nil
+}
+
+func (conn *Client) writeMessage(message outMessage) error {
+	if message.prepared != nil {
+		if socket, ok := conn.socket.(preparedWriter); ok {
+			return socket.WritePrepared(message.prepared)
 		}
 	}
+	return conn.socket.WriteMessage(message.data)
+}
+
+func (conn *Client) writePing() error {
+	if err := conn.extendWriteDeadline(); err != nil {
+		return err
+	}
+	return conn.socket.WritePing()
+}
+
+func (conn *Client) writeClose(farewell *closeFrame) {
+	if err := conn.extendWriteDeadline(); err != nil {
+		log.Println(err)
+		return
+	}
+	if err := conn.socket.WriteClose(farewell.code, farewell.reason); err != nil {
+		log.Println(err)
+	}
+}
+
+func (conn *Client) extendWriteDeadline() error {
+	if wait := conn.hub.config.WriteWait; wait > 0 {
+		return conn.socket.SetWriteDeadline(time.Now().Add(wait))
+	}
+	return nil
+}
+
+func (conn *Client) isIdle() bool {
+	timeout := conn.hub.config.IdleTimeout
+	if timeout == 0 {
+		return false
+	}
+	lastActive := time.Unix(0, atomic.LoadInt64(&conn.lastActive))
+	return time.Since(lastActive) > timeout
+}
+
+// extendReadDeadline gives the client another PongWait to send a message or
+// answer a ping before the connection is considered dead.
+func (conn *Client) extendReadDeadline() error {
+	if wait := conn.hub.config.PongWait; wait > 0 {
+		return conn.socket.SetReadDeadline(time.Now().Add(wait))
+	}
+	return nil
+}
+
+// setReason records why the client is being disconnected, only the first
+// cause is kept since closing the socket makes the other goroutine fail too.
+func (conn *Client) setReason(reason DisconnectReason) {
+	atomic.CompareAndSwapInt32(&conn.reason, 0, int32(reason)+1)
+}
+
+// DisconnectReason returns why the client was disconnected, it is only
+// meaningful once the client has been closed.
+func (conn *Client) DisconnectReason() DisconnectReason {
+	reason := atomic.LoadInt32(&conn.reason)
+	if reason == 0 {
+		return ReasonClosed
+	}
+	return DisconnectReason(reason - 1)
 }
 
 func (conn *Client) reader() {
+	// the client is unregistered by the worker handling its last message,
+	// so OnDisconnect always comes after OnMessage
 	defer func() {
-		conn.IsClosed = true
-		conn.hub.unregister <- conn
-		err := conn.socket.Close()
-		if err != nil {
-			log.Println(err)
+		conn.Close()
+		conn.hub.wg.Done()
+		if conn.inbox.finish() {
+			conn.hub.runQueue <- conn
 		}
 	}()
+	conn.socket.SetPongHandler(func() {
+		conn.rtt.pong(time.Now())
+		if err := conn.extendReadDeadline(); err != nil {
+			log.Println(err)
+		}
+	})
 	for {
-		messagesType, data, err := conn.socket.ReadMessage()
-		if messagesType == websocket.CloseMessage {
-			log.Println("Closing connection")
+		// the deadline is extended before each read rather than after the
+		// last one, so the time spent blocked in dispatch under backpressure
+		// isn't held against the client, whose pongs wait to be read
+		if err := conn.extendReadDeadline(); err != nil {
+			log.Println(err)
+			conn.setReason(ReasonReadError)
 			break
 		}
+		data, err := conn.socket.ReadMessage()
 		if err != nil {
-			log.Printf("error: %v", err)
-			if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				break
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Println("client timed out: ", conn.socket.RemoteAddr())
+				conn.setReason(ReasonTimeout)
+			} else if err == ErrMessageTooBig {
+				log.Println("disconnecting client sending oversized messages: ", conn.socket.RemoteAddr())
+				conn.setReason(ReasonMessageTooBig)
+			} else if err == io.EOF {
+				log.Println("Closing connection")
+				conn.setReason(ReasonClosed)
+			} else {
+				log.Printf("error: %v", err)
+				conn.setReason(ReasonReadError)
 			}
+			break
+		}
+		atomic.StoreInt64(&conn.lastActive, time.Now().UnixNano())
+		conn.traffic.received(data)
+		handle, keep := conn.rateLimit(data)
+		if !keep {
+			conn.setReason(ReasonRateLimited)
+			break
 		}
-		if messagesType != websocket.BinaryMessage {
-			log.Println("Expected BinaryMessage, got: ", messagesType)
+		if !handle {
 			continue
 		}
-		conn.hub.readBuffer <- ReadMessage{data, conn}
+		if !conn.hub.dispatch(conn, data) {
+			log.Println("disconnecting flooding client: ", conn.socket.RemoteAddr())
+			conn.setReason(ReasonOverload)
+			break
+		}
 	}
 }
 
+// Close closes the connection, it is safe to call more than once. Messages
+// still queued are dropped and later emits fail with ErrClosed.
+func (conn *Client) Close() {
+	conn.closeOnce.Do(func() {
+		conn.setReason(ReasonServer)
+		atomic.StoreInt32(&conn.closed, 1)
+		close(conn.done)
+		conn.queue.close()
+		if err := conn.socket.Close(); err != nil {
+			log.Println("error while closing: ", err)
+		}
+	})
+}
+
+// CloseWithReason closes the connection once the messages already emitted
+// have been sent, telling the client why with a close frame. Emits after it
+// fail with ErrClosed.
+func (conn *Client) CloseWithReason(code int, reason string) {
+	conn.setReason(ReasonServer)
+	conn.queue.finish(&closeFrame{code: code, reason: reason})
+}
+
+// ID returns the client's unique id, see Hub.Get.
+func (conn *Client) ID() string {
+	return conn.id
+}
+
+// Identity returns who the connection was authenticated as, or nil when its
+// transport has no Authenticator.
+func (conn *Client) Identity() *Identity {
+	return conn.identity
+}
+
+func (conn *Client) IsClosed() bool {
+	return atomic.LoadInt32(&conn.closed) == 1
+}
+
 func (conn *Client) Join(room string) {
-	conn.channels = append(conn.channels, room)
+	conn.hub.rooms.join(conn, room)
 }
 
-func (conn *Client) Leave(channel string) {
-	for i, v := range conn.channels {
-		if v == channel {
-			conn.channels = remove(conn.channels, i)
-			break
-		}
-	}
+func (conn *Client) Leave(room string) {
+	conn.hub.rooms.leave(conn, room)
 }
 
-func (conn *Client) IsInChannel(channel string) bool {
-	for _, v := range conn.channels {
-		if v == channel {
-			return true
-		}
-	}
-	return false
+func (conn *Client) IsInChannel(room string) bool {
+	return conn.hub.rooms.has(conn, room)
+}
+
+// Rooms returns the rooms the client is in, sorted by name.
+func (conn *Client) Rooms() []string {
+	return conn.hub.rooms.roomsOf(conn)
 }
 
+// Emit queues data to be written to the client without blocking. When the
+// queue is full the hub's SendQueuePolicy is applied, clients that fall too
+// far behind under the Disconnect policy are closed and ErrSlowConsumer is
+// returned. Events given PriorityHigh in the hub's Priorities overtake the
+// queued normal ones.
 func (conn *Client) Emit(data []byte) error {
-	if conn.IsClosed {
-		return errors.New("connection is closed")
+	return conn.EmitKeyed("", data)
+}
+
+// EmitKeyed works like Emit, but under the Coalesce policy replaces a queued
+// message with the same key, so that only the latest update is sent.
+func (conn *Client) EmitKeyed(key string, data []byte) error {
+	return conn.emit(outMessage{key: key, data: data})
+}
+
+// EmitBatch works like Emit for data wrapping several events into one
+// message, their traffic is counted per event rather than under the wrapper.
+func (conn *Client) EmitBatch(data []byte, events [][]byte) error {
+	return conn.emit(outMessage{data: data, events: events})
+}
+
+// EmitPrepared works like Emit for a message shared with other clients, see
+// PreparedMessage.
+func (conn *Client) EmitPrepared(message *PreparedMessage) error {
+	return conn.emit(outMessage{data: message.data, prepared: message, events: message.events})
+}
+
+func (conn *Client) emit(message outMessage) error {
+	message.priority = conn.hub.config.priority(message.data)
+	err := conn.queue.push(message)
+	if err == ErrSlowConsumer {
+		log.Println("disconnecting slow client: ", conn.socket.RemoteAddr())
+		conn.setReason(ReasonSlowConsumer)
+		conn.Close()
 	}
-	conn.send <- data
-	return nil
+	return err
+}
+
+// InboundStats returns the state of the client's inbound queue, Dropped
+// counts messages discarded under InboundDrop or InboundDisconnect.
+func (conn *Client) InboundStats() QueueStats {
+	return conn.inbox.stats()
+}
+
+// QueueStats returns the state of the client's send queue, including the
+// number of messages dropped or coalesced so far.
+func (conn *Client) QueueStats() QueueStats {
+	return conn.queue.stats()
 }
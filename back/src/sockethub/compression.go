@@ -0,0 +1,139 @@
+package sockethub
+
+import (
+	"compress/flate"
+	"sync"
+	"sync/atomic"
+)
+
+// CompressionPolicy decides which messages are compressed on connections
+// that negotiated permessage-deflate, messages are told apart by their first
+// byte like RateLimits. It applies to the messages as emitted, so events
+// wrapped in another message by the application are judged by that one.
+// The zero value compresses everything, as gorilla does by default.
+type CompressionPolicy struct {
+	// Level is the flate compression level, zero keeps the library default.
+	Level int
+	// MinSize is the smallest message compressed when its event is missing
+	// from Events, framing small messages costs more than it saves.
+	MinSize int
+	// Events forces compression on or off for some events.
+	Events map[byte]bool
+}
+
+func (p CompressionPolicy) compress(data []byte) bool {
+	if len(data) > 0 {
+		if compress, ok := p.Events[data[0]]; ok {
+			return compress
+		}
+	}
+	return len(data) >= p.MinSize
+}
+
+// compressor is implemented by connections supporting per message
+// compression.
+type compressor interface {
+	// Compressing reports whether compression was negotiated.
+	Compressing() bool
+	EnableWriteCompression(enable bool)
+	SetCompressionLevel(level int) error
+}
+
+// CompressionStats describes the messages of one event written to clients
+// that negotiated compression.
+type CompressionStats struct {
+	Messages uint64
+	// Compressed counts the messages sent compressed.
+	Compressed uint64
+	// RawBytes is the size of the messages before compression.
+	RawBytes uint64
+	// SentBytes is the size of their payloads as sent, after compression.
+	// Frame headers are left out.
+	SentBytes uint64
+}
+
+// Ratio returns SentBytes over RawBytes, below one when compression pays off.
+func (s CompressionStats) Ratio() float64 {
+	if s.RawBytes == 0 {
+		return 0
+	}
+	return float64(s.SentBytes) / float64(s.RawBytes)
+}
+
+// compressionStats counts with atomics since every writer records into it,
+// it is indexed by event.
+type compressionStats struct {
+	events [256]CompressionStats
+}
+
+func (c *compressionStats) record(data []byte, sent int, compressed bool) {
+	if len(data) == 0 {
+		return
+	}
+	stats := &c.events[data[0]]
+	atomic.AddUint64(&stats.Messages, 1)
+	if compressed {
+		atomic.AddUint64(&stats.Compressed, 1)
+	}
+	atomic.AddUint64(&stats.RawBytes, uint64(len(data)))
+	atomic.AddUint64(&stats.SentBytes, uint64(sent))
+}
+
+func (c *compressionStats) snapshot() map[byte]CompressionStats {
+	result := make(map[byte]CompressionStats)
+	for i := range c.events {
+		stats := &c.events[i]
+		if atomic.LoadUint64(&stats.Messages) == 0 {
+			continue
+		}
+		result[byte(i)] = CompressionStats{
+			Messages:   atomic.LoadUint64(&stats.Messages),
+			Compressed: atomic.LoadUint64(&stats.Compressed),
+			RawBytes:   atomic.LoadUint64(&stats.RawBytes),
+			SentBytes:  atomic.LoadUint64(&stats.SentBytes),
+		}
+	}
+	return result
+}
+
+// defaultCompressionLevel is the level gorilla compresses with when
+// CompressionPolicy.Level is zero.
+const defaultCompressionLevel = flate.BestSpeed
+
+// flateWriters keeps a pool of writers per level, indexed from
+// flate.HuffmanOnly.
+var flateWriters [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+// byteCounter discards what is written to it, counting the bytes.
+type byteCounter int
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// compressedSize returns the size of data compressed at level the way
+// permessage-deflate without context takeover does, as gorilla sends it.
+// It compresses data again rather than counting what gorilla writes to the
+// network, which also carries the control frames written concurrently.
+func compressedSize(data []byte, level int) int {
+	if level == 0 {
+		level = defaultCompressionLevel
+	}
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return len(data)
+	}
+	var size byteCounter
+	pool := &flateWriters[level-flate.HuffmanOnly]
+	writer, _ := pool.Get().(*flate.Writer)
+	if writer == nil {
+		writer, _ = flate.NewWriter(&size, level)
+	} else {
+		writer.Reset(&size)
+	}
+	writer.Write(data)
+	writer.Flush()
+	pool.Put(writer)
+	// the empty block ending the flush is left out of the frame
+	return int(size) - 4
+}
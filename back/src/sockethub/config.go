@@ -0,0 +1,141 @@
+package sockethub
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+type Config struct {
+	// ReadLimit is the largest message accepted from clients, larger ones
+	// close the connection with CloseMessageTooBig. Zero disables the limit.
+	ReadLimit int64
+	// ReadBufferSize and WriteBufferSize are the websocket I/O buffer sizes.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// AllowedOrigins lists the origins browsers may connect from, "*" allows
+	// any. When empty only same origin requests are accepted.
+	AllowedOrigins []string
+	// Subprotocols are the websocket subprotocols supported, in order of
+	// preference.
+	Subprotocols []string
+	// HandshakeTimeout bounds the websocket handshake, zero disables it.
+	HandshakeTimeout time.Duration
+	// EnableCompression negotiates permessage-deflate with clients offering
+	// it, see Compression.
+	EnableCompression bool
+	// SendQueueSize is the number of outbound messages buffered per client,
+	// all priorities together. Zero or less uses the default.
+	SendQueueSize int
+	// SendQueuePolicy is applied when a client's send queue is full.
+	SendQueuePolicy OverflowPolicy
+	// PingInterval is how often clients are pinged, zero disables pings.
+	PingInterval time.Duration
+	// PongWait is how long a client may stay silent, answering pings counts,
+	// before its connection is considered dead. Zero disables read deadlines.
+	PongWait time.Duration
+	// WriteWait is the time allowed to write a single message.
+	WriteWait time.Duration
+	// IdleTimeout disconnects clients that send no messages for this long,
+	// even if they keep answering pings. Zero disables it.
+	IdleTimeout time.Duration
+	// Workers is the number of goroutines running OnMessage, messages of a
+	// single client are always handled one at a time and in order.
+	Workers int
+	// InboundQueueSize is the number of received messages buffered per client.
+	// Zero or less uses the default.
+	InboundQueueSize int
+	// InboundPolicy is applied when a client's inbound queue is full.
+	InboundPolicy InboundPolicy
+	// RateLimits limits each event, the first byte of a message, separately.
+	RateLimits map[byte]RateLimit
+	// DefaultRateLimit applies to events missing from RateLimits, nil leaves
+	// them unlimited.
+	DefaultRateLimit *RateLimit
+	// BanDuration is how long an IP stays banned under RateLimitBan.
+	BanDuration time.Duration
+	// TrustedProxies lists the IPs or CIDR ranges of the reverse proxies in
+	// front of the hub. Clients connecting through them are banned by the
+	// address found in X-Forwarded-For rather than the proxy's. The header is
+	// ignored when empty, since clients can set it themselves.
+	TrustedProxies []string
+	// Compression applies to connections that negotiated permessage-deflate,
+	// which WebsocketTransport does when its upgrader enables compression.
+	Compression CompressionPolicy
+	// Priorities sets the send priority of events, the first byte of a
+	// message, others are sent with PriorityNormal.
+	Priorities map[byte]Priority
+}
+
+// Upgrader returns a websocket upgrader applying the config, for
+// NewWebsocketTransport.
+func (c Config) Upgrader() websocket.Upgrader {
+	upgrader := websocket.Upgrader{
+		HandshakeTimeout:  c.HandshakeTimeout,
+		ReadBufferSize:    c.ReadBufferSize,
+		WriteBufferSize:   c.WriteBufferSize,
+		Subprotocols:      c.Subprotocols,
+		EnableCompression: c.EnableCompression,
+	}
+	if len(c.AllowedOrigins) > 0 {
+		origins := &OriginAuth{Allowed: c.AllowedOrigins}
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			_, err := origins.Authenticate(r)
+			return err == nil
+		}
+	}
+	return upgrader
+}
+
+// normalized replaces the settings that would leave the hub unable to work
+// with their defaults.
+func (c Config) normalized() Config {
+	defaults := DefaultConfig()
+	if c.SendQueueSize <= 0 {
+		c.SendQueueSize = defaults.SendQueueSize
+	}
+	if c.InboundQueueSize <= 0 {
+		c.InboundQueueSize = defaults.InboundQueueSize
+	}
+	return c
+}
+
+func (c Config) priority(data []byte) Priority {
+	if len(data) == 0 {
+		return PriorityNormal
+	}
+	return c.Priorities[data[0]]
+}
+
+func (c Config) heartbeatInterval() time.Duration {
+	if c.PingInterval > 0 {
+		return c.PingInterval
+	}
+	return c.IdleTimeout / 4
+}
+
+// DefaultConfig disconnects clients that fall more than a few seconds of game
+// ticks behind, since dropping game events would desync their state.
+func DefaultConfig() Config {
+	return Config{
+		ReadLimit:        64 << 10,
+		ReadBufferSize:   1024,
+		WriteBufferSize:  2048,
+		HandshakeTimeout: 10 * time.Second,
+
+		SendQueueSize:   256,
+		SendQueuePolicy: Disconnect,
+		PingInterval:    10 * time.Second,
+		PongWait:        30 * time.Second,
+		WriteWait:       10 * time.Second,
+		IdleTimeout:     2 * time.Minute,
+
+		Workers:          runtime.NumCPU(),
+		InboundQueueSize: 64,
+		InboundPolicy:    InboundBlock,
+		BanDuration:      10 * time.Minute,
+
+		Compression: CompressionPolicy{MinSize: 256},
+	}
+}
@@ -0,0 +1,69 @@
+package sockethub
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	ErrTransportClosed = errors.New("transport is closed")
+	// ErrMessageTooBig is returned by ReadMessage for messages over the read
+	// limit, the peer has then been sent a CloseMessageTooBig close frame.
+	ErrMessageTooBig = errors.New("message exceeds the read limit")
+)
+
+// Close codes for Client.CloseWithReason, see RFC 6455 section 7.4.1.
+const (
+	CloseNormalClosure   = 1000
+	CloseGoingAway       = 1001
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseServiceRestart  = 1012
+)
+
+// Conn is a message oriented connection to a single client. ReadMessage
+// returns io.EOF once the peer has closed the connection cleanly and a
+// net.Error whose Timeout() is true when the read deadline passes.
+type Conn interface {
+	ReadMessage() ([]byte, error)
+	WriteMessage(data []byte) error
+	// WritePing sends a keepalive the peer is expected to answer, the answer
+	// is reported to the pong handler while a ReadMessage call is running.
+	WritePing() error
+	SetPongHandler(handler func())
+	// WriteClose tells the peer why the connection is about to be closed.
+	WriteClose(code int, reason string) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// readLimiter is implemented by connections that can refuse messages larger
+// than limit bytes, see Config.ReadLimit.
+type readLimiter interface {
+	SetReadLimit(limit int64)
+}
+
+// identified is implemented by connections that were authenticated, see
+// Client.Identity.
+type identified interface {
+	Identity() *Identity
+}
+
+// forwarded is implemented by connections upgraded from an HTTP request, see
+// Config.TrustedProxies.
+type forwarded interface {
+	// ForwardedFor returns the addresses of the X-Forwarded-For header, the
+	// client first and the closest proxy last.
+	ForwardedFor() []string
+}
+
+// Transport accepts connections from clients, see Hub.Serve.
+type Transport interface {
+	// Accept blocks until a client connects, it returns ErrTransportClosed
+	// once the transport is closed.
+	Accept() (Conn, error)
+	Close() error
+}
@@ -1,90 +1,374 @@
 package sockethub
 
 import (
+	"context"
+	"github.com/frankenbeanies/uuid4"
 	"github.com/gorilla/websocket"
+	"log"
+	"sync"
+	"time"
 )
 
-type BroadcastMessage struct {
-	Data     []byte
-	channels []string
-}
-
-type ReadMessage struct {
-	Data   []byte
-	Client *Client
-}
-
 type EventHandler struct {
 	Event    string
 	Callback func(data interface{}, client *Client)
 }
 
+// runQueueSize only bounds how many clients can be waiting for a worker before
+// their readers block.
+const runQueueSize = 1024
+
 type Hub struct {
+	// id tells this hub's broker messages apart from the others.
+	id string
+	mu sync.Mutex
 	// Registered clients.
-	clients map[*Client]bool
+	clients      map[*Client]bool
+	byId         map[string]*Client
+	transports   map[Transport]struct{}
+	shuttingDown bool
+	// wg counts the reader, the writer and the unregistration of every
+	// client, Shutdown waits for all of them.
+	wg       sync.WaitGroup
+	quit     chan struct{}
+	quitOnce sync.Once
 
-	// Inbound messages from the clients.
-	broadcast  chan BroadcastMessage
-	readBuffer chan ReadMessage
+	rooms       *roomIndex
+	bans        *banList
+	proxies     proxyList
+	compression *compressionStats
+	broker      Broker
+	// sharedRooms are the rooms published through broker, nil shares all.
+	sharedRooms map[string]struct{}
+
+	// Clients with inbound messages waiting for a worker.
+	runQueue chan *Client
 
 	// Register requests from the clients.
 	register chan *Client
 
 	// Unregister requests from clients.
-	unregister chan *Client
-	onMessage  func(data []byte, client *Client)
+	unregister   chan *Client
+	onMessage    func(data []byte, client *Client)
+	onConnect    func(client *Client)
+	onDisconnect func(client *Client, reason DisconnectReason)
+	config       Config
 }
 
 func NewHub() *Hub {
+	return NewHubWithConfig(DefaultConfig())
+}
+
+func NewHubWithConfig(config Config) *Hub {
 	h := Hub{
-		readBuffer: make(chan ReadMessage),
-		broadcast:  make(chan BroadcastMessage),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
+		id:          uuid4.New().String(),
+		config:      config.normalized(),
+		runQueue:    make(chan *Client, runQueueSize),
+		rooms:       newRoomIndex(),
+		bans:        newBanList(),
+		proxies:     newProxyList(config.TrustedProxies),
+		compression: &compressionStats{},
+		register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		clients:     make(map[*Client]bool),
+		byId:        make(map[string]*Client),
+		transports:  make(map[Transport]struct{}),
+		quit:        make(chan struct{}),
 	}
 	return &h
 }
 
 func (h *Hub) Run() {
+	workers := h.config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go h.worker()
+	}
 	for {
 		select {
 		case client := <-h.register:
-			h.clients[client] = true
-		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+			if h.onConnect != nil {
+				h.onConnect(client)
 			}
-		case message := <-h.broadcast:
-			for client := range h.clients {
-				isCorrectRecipient := false
-				for _, c := range message.channels {
-					isCorrectRecipient = isCorrectRecipient || client.IsInChannel(c)
-				}
-				if !isCorrectRecipient {
-					continue
+		case client := <-h.unregister:
+			h.mu.Lock()
+			_, ok := h.clients[client]
+			delete(h.clients, client)
+			delete(h.byId, client.id)
+			h.mu.Unlock()
+			if ok {
+				h.rooms.leaveAll(client)
+				client.queue.close()
+				if h.onDisconnect != nil {
+					h.onDisconnect(client, client.DisconnectReason())
 				}
-				client.send <- message.Data
+				h.wg.Done()
 			}
-		case message := <-h.readBuffer:
-			go h.onMessage(message.Data, message.Client)
+		case <-h.quit:
+			return
 		}
 	}
 }
 
+// OnMessage registers the callback handling messages, it runs on one of the
+// hub's workers and is never called concurrently for the same client.
 func (h *Hub) OnMessage(callback func(data []byte, client *Client)) {
 	h.onMessage = callback
 }
 
+// OnConnect registers a callback invoked from the hub goroutine once a client
+// is registered, before any of its messages reach OnMessage.
+func (h *Hub) OnConnect(callback func(client *Client)) {
+	h.onConnect = callback
+}
+
+// OnDisconnect registers a callback invoked from the hub goroutine exactly once
+// per client, after it has been unregistered.
+func (h *Hub) OnDisconnect(callback func(client *Client, reason DisconnectReason)) {
+	h.onDisconnect = callback
+}
+
+// AddConnection registers a gorilla websocket connection, see AddConn.
 func (h *Hub) AddConnection(ws *websocket.Conn) *Client {
-	client := &Client{socket: ws, send: make(chan []byte), hub: h}
+	return h.AddConn(NewWebsocketConn(ws))
+}
+
+// AddConn registers a client on conn and starts serving it. Connections
+// from banned IPs or arriving during Shutdown are closed right away and nil
+// is returned.
+func (h *Hub) AddConn(conn Conn) *Client {
+	host := h.clientHost(conn)
+	if h.IsBanned(host) {
+		log.Println("refusing connection from banned client: ", host)
+		conn.Close()
+		return nil
+	}
+	h.mu.Lock()
+	if h.shuttingDown {
+		h.mu.Unlock()
+		conn.WriteClose(CloseGoingAway, "server shutting down")
+		conn.Close()
+		return nil
+	}
+	now := time.Now()
+	client := &Client{
+		lastActive:  now.UnixNano(),
+		connectedAt: now,
+		traffic:     newTraffic(),
+		id:          uuid4.New().String(),
+		socket:      conn,
+		host:        host,
+		queue:       newSendQueue(h.config.SendQueueSize, h.config.SendQueuePolicy),
+		inbox:       newInbox(h.config.InboundQueueSize),
+		limiter:     newRateLimiter(h.config),
+		done:        make(chan struct{}),
+		hub:         h,
+	}
+	if conn, ok := conn.(identified); ok {
+		client.identity = conn.Identity()
+	}
+	if conn, ok := conn.(readLimiter); ok && h.config.ReadLimit > 0 {
+		conn.SetReadLimit(h.config.ReadLimit)
+	}
+	if conn, ok := conn.(compressor); ok && h.config.Compression.Level != 0 {
+		if err := conn.SetCompressionLevel(h.config.Compression.Level); err != nil {
+			log.Println(err)
+		}
+	}
+	// added under the lock so that a concurrent Shutdown either refuses the
+	// connection or sees the client
+	h.clients[client] = true
+	h.byId[client.id] = client
+	h.wg.Add(3)
+	h.mu.Unlock()
+	// register first, so that OnConnect comes before anything else
+	h.register <- client
 	go client.reader()
 	go client.writer()
-	h.register <- client
 	return client
 }
 
+// Serve adds every connection accepted by transport until it is closed, the
+// returned error is the one that stopped Accept.
+func (h *Hub) Serve(transport Transport) error {
+	h.mu.Lock()
+	if h.shuttingDown {
+		h.mu.Unlock()
+		transport.Close()
+		return ErrTransportClosed
+	}
+	h.transports[transport] = struct{}{}
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.transports, transport)
+		h.mu.Unlock()
+	}()
+	for {
+		conn, err := transport.Accept()
+		if err != nil {
+			return err
+		}
+		h.AddConn(conn)
+	}
+}
+
+// Shutdown stops the hub, telling clients the server is going away, see
+// ShutdownWithReason.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	return h.ShutdownWithReason(ctx, CloseGoingAway, "server shutting down")
+}
+
+// ShutdownWithReason closes every transport being served, flushes the
+// messages queued for each client and closes it with code and reason. It
+// returns once every client has been disconnected and Run has stopped, or
+// closes the remaining connections abruptly and returns the context's error
+// when ctx is done first.
+func (h *Hub) ShutdownWithReason(ctx context.Context, code int, reason string) error {
+	h.mu.Lock()
+	h.shuttingDown = true
+	transports := make([]Transport, 0, len(h.transports))
+	for transport := range h.transports {
+		transports = append(transports, transport)
+	}
+	clients := make([]*Client, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mu.Unlock()
+
+	for _, transport := range transports {
+		if err := transport.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	for _, client := range clients {
+		client.setReason(ReasonShutdown)
+		client.CloseWithReason(code, reason)
+	}
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		h.quitOnce.Do(func() {
+			close(h.quit)
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, client := range clients {
+			client.Close()
+		}
+		return ctx.Err()
+	}
+}
+
 func (h *Hub) Emit(data []byte, channel string) {
-	h.broadcast <- BroadcastMessage{data, []string{channel}}
+	h.EmitTo(data, channel)
+}
+
+// EmitTo sends data to every client in any of the rooms, clients in several
+// of them receive it once.
+func (h *Hub) EmitTo(data []byte, rooms ...string) {
+	h.EmitExcept(data, nil, rooms...)
+}
+
+// EmitExcept works like EmitTo but skips except, typically the client whose
+// message caused the broadcast. data is framed once for all of them, so it
+// must not be modified afterwards.
+func (h *Hub) EmitExcept(data []byte, except *Client, rooms ...string) {
+	h.emitLocal(data, except, rooms)
+	if h.broker == nil {
+		return
+	}
+	if shared := h.shared(rooms); len(shared) > 0 {
+		err := h.broker.Publish(BrokerMessage{Origin: h.id, Rooms: shared, Data: data})
+		if err != nil {
+			log.Println("error while publishing to the broker: ", err)
+		}
+	}
+}
+
+func (h *Hub) emitLocal(data []byte, except *Client, rooms []string) {
+	message := NewPreparedMessage(data)
+	for _, client := range h.rooms.clients(rooms, except) {
+		if err := client.EmitPrepared(message); err != nil && err != ErrClosed {
+			log.Println(err)
+		}
+	}
+}
+
+func (h *Hub) shared(rooms []string) []string {
+	if h.sharedRooms == nil {
+		return rooms
+	}
+	shared := make([]string, 0, len(rooms))
+	for _, room := range rooms {
+		if _, ok := h.sharedRooms[room]; ok {
+			shared = append(shared, room)
+		}
+	}
+	return shared
+}
+
+// UseBroker shares broadcasts to rooms with the other hubs using broker,
+// every room is shared when none are given. Each hub only delivers messages
+// to its own clients, so the rooms of a client are still local to its hub.
+// It must be called before the hub starts serving clients.
+func (h *Hub) UseBroker(broker Broker, rooms ...string) {
+	h.broker = broker
+	if len(rooms) > 0 {
+		h.sharedRooms = make(map[string]struct{}, len(rooms))
+		for _, room := range rooms {
+			h.sharedRooms[room] = struct{}{}
+		}
+	}
+	broker.Subscribe(func(message BrokerMessage) {
+		if message.Origin != h.id {
+			h.emitLocal(message.Data, nil, message.Rooms)
+		}
+	})
+}
+
+// Get returns the registered client with id.
+func (h *Hub) Get(id string) (*Client, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client, ok := h.byId[id]
+	return client, ok
+}
+
+// EmitToClient sends data to the client with id, ErrUnknownClient is
+// returned once it has been unregistered.
+func (h *Hub) EmitToClient(id string, data []byte) error {
+	client, ok := h.Get(id)
+	if !ok {
+		return ErrUnknownClient
+	}
+	return client.Emit(data)
+}
+
+// CompressionStats returns how well the messages of each event, keyed by
+// their first byte, compressed so far.
+func (h *Hub) CompressionStats() map[byte]CompressionStats {
+	return h.compression.snapshot()
+}
+
+// InRoom returns the clients currently in room.
+func (h *Hub) InRoom(room string) []*Client {
+	return h.rooms.clients([]string{room}, nil)
+}
+
+// RoomSize returns the number of clients in room.
+func (h *Hub) RoomSize(room string) int {
+	return h.rooms.count(room)
+}
+
+// RoomCounts returns the number of clients in every non-empty room.
+func (h *Hub) RoomCounts() map[string]int {
+	return h.rooms.counts()
 }
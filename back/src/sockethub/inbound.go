@@ -0,0 +1,166 @@
+package sockethub
+
+import (
+	"sync"
+)
+
+// InboundPolicy decides what happens to a message received from a client
+// whose inbound queue is already full.
+type InboundPolicy int
+
+const (
+	// InboundBlock stops reading from the client until there is room, so
+	// that the transport pushes back on the sender.
+	InboundBlock InboundPolicy = iota
+	// InboundDrop discards the message that did not fit.
+	InboundDrop
+	// InboundDisconnect closes the connection of a client flooding the hub.
+	InboundDisconnect
+)
+
+// dispatchFairness is the number of messages a worker handles for one client
+// before giving other clients a turn.
+const dispatchFairness = 16
+
+// inbox holds the messages received from a client until a worker hands them
+// to OnMessage. A client is in the hub's run queue at most once, which keeps
+// its messages in order while different clients are handled in parallel.
+type inbox struct {
+	mu        sync.Mutex
+	messages  [][]byte
+	size      int
+	scheduled bool
+	// finished is set once the reader is done, the worker that empties the
+	// inbox afterwards unregisters the client.
+	finished bool
+	space    chan struct{}
+	dropped  uint64
+}
+
+func newInbox(size int) *inbox {
+	return &inbox{size: size, space: make(chan struct{}, 1)}
+}
+
+// push appends data and reports whether the client has to be put on the run
+// queue, full is true when there was no room for data.
+func (in *inbox) push(data []byte) (schedule bool, full bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if len(in.messages) >= in.size {
+		return false, true
+	}
+	in.messages = append(in.messages, data)
+	return in.schedule(), false
+}
+
+// finish marks the end of the client's messages and reports whether the
+// client has to be put on the run queue.
+func (in *inbox) finish() bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.finished = true
+	return in.schedule()
+}
+
+func (in *inbox) schedule() bool {
+	if in.scheduled {
+		return false
+	}
+	in.scheduled = true
+	return true
+}
+
+// pop returns the next message, when there is none the client is taken off
+// the run queue and finished reports whether the reader is done.
+func (in *inbox) pop() (data []byte, ok bool, finished bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if len(in.messages) == 0 {
+		in.scheduled = false
+		return nil, false, in.finished
+	}
+	data = in.messages[0]
+	in.messages[0] = nil
+	in.messages = in.messages[1:]
+	select {
+	case in.space <- struct{}{}:
+	default:
+	}
+	return data, true, false
+}
+
+func (in *inbox) drop() {
+	in.mu.Lock()
+	in.dropped++
+	in.mu.Unlock()
+}
+
+func (in *inbox) stats() QueueStats {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return QueueStats{Queued: len(in.messages), Dropped: in.dropped}
+}
+
+// dispatch queues a message read from client according to the hub's
+// InboundPolicy, it returns false when the client has to be disconnected.
+func (h *Hub) dispatch(client *Client, data []byte) bool {
+	for {
+		schedule, full := client.inbox.push(data)
+		if schedule {
+			h.runQueue <- client
+		}
+		if !full {
+			return true
+		}
+		switch h.config.InboundPolicy {
+		case InboundDrop:
+			client.inbox.drop()
+			return true
+		case InboundDisconnect:
+			client.inbox.drop()
+			return false
+		}
+		select {
+		case <-client.inbox.space:
+		case <-client.done:
+			return false
+		}
+	}
+}
+
+// worker hands queued messages to OnMessage, see inbox.
+func (h *Hub) worker() {
+	for {
+		select {
+		case client := <-h.runQueue:
+			h.drain(client)
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+func (h *Hub) drain(client *Client) {
+	for handled := 0; ; handled++ {
+		if handled == dispatchFairness {
+			select {
+			case h.runQueue <- client:
+				return
+			default:
+				// every other worker is busy as well, carry on with this client
+				handled = 0
+			}
+		}
+		data, ok, finished := client.inbox.pop()
+		if !ok {
+			if finished {
+				h.unregister <- client
+			}
+			return
+		}
+		if client.IsClosed() || h.onMessage == nil {
+			continue
+		}
+		h.onMessage(data, client)
+	}
+}
@@ -0,0 +1,288 @@
+package sockethub
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// brokerPeerQueueSize is the number of messages buffered for a slow peer of
+// a BrokerServer before its messages are dropped.
+const brokerPeerQueueSize = 256
+
+// BrokerServer relays the messages published by each NetworkBroker
+// connected to it to all the others. It speaks the stream protocol, one
+// broker message per data frame.
+type BrokerServer struct {
+	transport *StreamTransport
+	mu        sync.Mutex
+	peers     map[*brokerPeer]struct{}
+}
+
+type brokerPeer struct {
+	conn  Conn
+	queue chan []byte
+}
+
+// ListenBroker starts a BrokerServer on a TCP or Unix domain socket address,
+// Serve must then be called to accept peers.
+func ListenBroker(network, address string) (*BrokerServer, error) {
+	transport, err := ListenStream(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &BrokerServer{transport: transport, peers: make(map[*brokerPeer]struct{})}, nil
+}
+
+func (s *BrokerServer) Addr() net.Addr {
+	return s.transport.Addr()
+}
+
+// Serve accepts peers until the server is closed.
+func (s *BrokerServer) Serve() error {
+	for {
+		conn, err := s.transport.Accept()
+		if err != nil {
+			return err
+		}
+		peer := &brokerPeer{conn: conn, queue: make(chan []byte, brokerPeerQueueSize)}
+		s.mu.Lock()
+		s.peers[peer] = struct{}{}
+		s.mu.Unlock()
+		go s.write(peer)
+		go s.read(peer)
+	}
+}
+
+func (s *BrokerServer) read(peer *brokerPeer) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.peers, peer)
+		s.mu.Unlock()
+		close(peer.queue)
+	}()
+	for {
+		data, err := peer.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		s.relay(peer, data)
+	}
+}
+
+func (s *BrokerServer) relay(from *brokerPeer, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for peer := range s.peers {
+		if peer == from {
+			continue
+		}
+		select {
+		case peer.queue <- data:
+		default:
+			log.Println("dropping broker message for slow peer: ", peer.conn.RemoteAddr())
+		}
+	}
+}
+
+func (s *BrokerServer) write(peer *brokerPeer) {
+	defer peer.conn.Close()
+	for data := range peer.queue {
+		if err := peer.conn.WriteMessage(data); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
+
+// Peers returns the number of connected peers.
+func (s *BrokerServer) Peers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.peers)
+}
+
+// Close stops accepting peers and disconnects the current ones.
+func (s *BrokerServer) Close() error {
+	err := s.transport.Close()
+	s.mu.Lock()
+	for peer := range s.peers {
+		peer.conn.Close()
+	}
+	s.mu.Unlock()
+	return err
+}
+
+// Settings of NetworkBroker: messages published while the connection is
+// lost or slow are queued up to brokerPublishQueueSize, and the connection
+// is dialed again with an exponential backoff.
+const (
+	brokerPublishQueueSize = 256
+	brokerWriteWait        = 5 * time.Second
+	brokerMinBackoff       = 100 * time.Millisecond
+	brokerMaxBackoff       = 5 * time.Second
+)
+
+// ErrBrokerBacklog is returned by NetworkBroker.Publish when its queue is
+// full, the message has still been delivered locally.
+var ErrBrokerBacklog = errors.New("broker publish queue is full")
+
+// NetworkBroker is a Broker publishing through a BrokerServer. The server
+// doesn't echo messages back, so they are handed to local handlers directly.
+// Publish never waits for the network: messages are written by a background
+// goroutine, which reconnects whenever the connection is lost.
+type NetworkBroker struct {
+	network   string
+	address   string
+	queue     chan []byte
+	quit      chan struct{}
+	closeOnce sync.Once
+	mu        sync.RWMutex
+	handlers  []func(message BrokerMessage)
+}
+
+// DialBroker connects to a BrokerServer, network is "tcp" or "unix". Only
+// the first connection has to succeed, later ones are retried until Close.
+func DialBroker(network, address string) (*NetworkBroker, error) {
+	conn, err := dialBroker(network, address)
+	if err != nil {
+		return nil, err
+	}
+	b := &NetworkBroker{
+		network: network,
+		address: address,
+		queue:   make(chan []byte, brokerPublishQueueSize),
+		quit:    make(chan struct{}),
+	}
+	go b.run(conn)
+	return b, nil
+}
+
+func dialBroker(network, address string) (Conn, error) {
+	conn, err := net.DialTimeout(network, address, brokerWriteWait)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamConn(conn), nil
+}
+
+// run serves conn and dials again whenever it is lost, until Close.
+func (b *NetworkBroker) run(conn Conn) {
+	for conn != nil {
+		b.serve(conn)
+		conn = b.redial()
+	}
+}
+
+// serve writes the queued messages to conn until it fails or the broker is
+// closed, the message being written when it fails is lost.
+func (b *NetworkBroker) serve(conn Conn) {
+	defer conn.Close()
+	lost := make(chan struct{})
+	go func() {
+		b.read(conn)
+		close(lost)
+	}()
+	for {
+		select {
+		case data := <-b.queue:
+			conn.SetWriteDeadline(time.Now().Add(brokerWriteWait))
+			if err := conn.WriteMessage(data); err != nil {
+				log.Println("broker connection lost: ", err)
+				return
+			}
+		case <-lost:
+			return
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// redial returns a new connection to the server, or nil once the broker is
+// closed.
+func (b *NetworkBroker) redial() Conn {
+	backoff := brokerMinBackoff
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-b.quit:
+			return nil
+		}
+		conn, err := dialBroker(b.network, b.address)
+		if err == nil {
+			log.Println("broker reconnected: ", b.address)
+			return conn
+		}
+		log.Println("broker reconnect failed: ", err)
+		if backoff *= 2; backoff > brokerMaxBackoff {
+			backoff = brokerMaxBackoff
+		}
+	}
+}
+
+func (b *NetworkBroker) read(conn Conn) {
+	for {
+		data, err := conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-b.quit:
+			default:
+				log.Println("broker connection lost: ", err)
+			}
+			return
+		}
+		message, err := decodeBrokerMessage(data)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		b.deliver(message)
+	}
+}
+
+func (b *NetworkBroker) deliver(message BrokerMessage) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(message)
+	}
+}
+
+// Publish delivers message to the local handlers and queues it for the
+// server, it returns ErrBrokerBacklog rather than blocking when the queue is
+// full.
+func (b *NetworkBroker) Publish(message BrokerMessage) error {
+	select {
+	case <-b.quit:
+		return ErrBrokerClosed
+	default:
+	}
+	data, err := encodeBrokerMessage(message)
+	if err != nil {
+		return err
+	}
+	b.deliver(message)
+	select {
+	case b.queue <- data:
+		return nil
+	default:
+		return ErrBrokerBacklog
+	}
+}
+
+func (b *NetworkBroker) Subscribe(handler func(message BrokerMessage)) {
+	b.mu.Lock()
+	b.handlers = append(b.handlers, handler)
+	b.mu.Unlock()
+}
+
+// Close disconnects from the server, messages still queued are dropped.
+func (b *NetworkBroker) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.quit)
+	})
+	return nil
+}
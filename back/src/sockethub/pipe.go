@@ -0,0 +1,238 @@
+package sockethub
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// pipeBuffer is the number of frames a pipe end accepts before writes block.
+const pipeBuffer = 64
+
+var errPipeClosed = errors.New("pipe is closed")
+
+type pipeFrameKind int
+
+const (
+	pipeData pipeFrameKind = iota
+	pipePing
+	pipePong
+	pipeClose
+)
+
+type pipeFrame struct {
+	kind pipeFrameKind
+	data []byte
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+type pipeTimeout struct{}
+
+func (pipeTimeout) Error() string {
+	return "pipe deadline exceeded"
+}
+
+func (pipeTimeout) Timeout() bool {
+	return true
+}
+
+func (pipeTimeout) Temporary() bool {
+	return true
+}
+
+// pipeConn is one end of an in-memory connection, it behaves like a
+// websocket: pings are answered by the peer's reader and reads fail with
+// io.EOF once the peer closes and everything it sent has been read.
+type pipeConn struct {
+	in         chan pipeFrame
+	out        chan pipeFrame
+	closed     chan struct{}
+	peerClosed chan struct{}
+	closeOnce  sync.Once
+	remote     net.Addr
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	onPong        func()
+}
+
+// Pipe returns the two ends of an in-memory Conn, meant for running clients
+// in the same process as the hub, mostly in tests.
+func Pipe() (Conn, Conn) {
+	a := make(chan pipeFrame, pipeBuffer)
+	b := make(chan pipeFrame, pipeBuffer)
+	aClosed := make(chan struct{})
+	bClosed := make(chan struct{})
+	server := &pipeConn{in: a, out: b, closed: aClosed, peerClosed: bClosed, remote: pipeAddr("pipe-client")}
+	client := &pipeConn{in: b, out: a, closed: bClosed, peerClosed: aClosed, remote: pipeAddr("pipe-server")}
+	return server, client
+}
+
+// deadline returns a channel firing at t, or nil for the zero time.
+func deadline(t time.Time) (<-chan time.Time, func() bool) {
+	if t.IsZero() {
+		return nil, func() bool { return false }
+	}
+	timer := time.NewTimer(time.Until(t))
+	return timer.C, timer.Stop
+}
+
+func (c *pipeConn) ReadMessage() ([]byte, error) {
+	for {
+		c.mu.Lock()
+		timeout, stop := deadline(c.readDeadline)
+		c.mu.Unlock()
+		var frame pipeFrame
+		select {
+		case frame = <-c.in:
+		case <-c.closed:
+			stop()
+			return nil, errPipeClosed
+		case <-c.peerClosed:
+			stop()
+			select {
+			case frame = <-c.in:
+			default:
+				return nil, io.EOF
+			}
+		case <-timeout:
+			return nil, pipeTimeout{}
+		}
+		stop()
+		switch frame.kind {
+		case pipeData:
+			return frame.data, nil
+		case pipePing:
+			if err := c.write(pipeFrame{kind: pipePong}); err != nil {
+				return nil, err
+			}
+		case pipeClose:
+			return nil, io.EOF
+		case pipePong:
+			c.mu.Lock()
+			onPong := c.onPong
+			c.mu.Unlock()
+			if onPong != nil {
+				onPong()
+			}
+		}
+	}
+}
+
+func (c *pipeConn) write(frame pipeFrame) error {
+	c.mu.Lock()
+	timeout, stop := deadline(c.writeDeadline)
+	c.mu.Unlock()
+	defer stop()
+	select {
+	case <-c.closed:
+		return errPipeClosed
+	case <-c.peerClosed:
+		return io.ErrClosedPipe
+	default:
+	}
+	select {
+	case c.out <- frame:
+		return nil
+	case <-c.closed:
+		return errPipeClosed
+	case <-c.peerClosed:
+		return io.ErrClosedPipe
+	case <-timeout:
+		return pipeTimeout{}
+	}
+}
+
+func (c *pipeConn) WriteMessage(data []byte) error {
+	return c.write(pipeFrame{kind: pipeData, data: data})
+}
+
+func (c *pipeConn) WritePing() error {
+	return c.write(pipeFrame{kind: pipePing})
+}
+
+func (c *pipeConn) WriteClose(code int, reason string) error {
+	return c.write(pipeFrame{kind: pipeClose})
+}
+
+func (c *pipeConn) SetPongHandler(handler func()) {
+	c.mu.Lock()
+	c.onPong = handler
+	c.mu.Unlock()
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *pipeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+// MemoryTransport connects in-process clients created with Dial to a hub.
+type MemoryTransport struct {
+	conns     chan Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{conns: make(chan Conn), closed: make(chan struct{})}
+}
+
+// Dial connects a new client and returns its end of the pipe, it blocks until
+// the connection is accepted.
+func (t *MemoryTransport) Dial() (Conn, error) {
+	server, client := Pipe()
+	select {
+	case t.conns <- server:
+		return client, nil
+	case <-t.closed:
+		return nil, ErrTransportClosed
+	}
+}
+
+func (t *MemoryTransport) Accept() (Conn, error) {
+	select {
+	case conn := <-t.conns:
+		return conn, nil
+	case <-t.closed:
+		return nil, ErrTransportClosed
+	}
+}
+
+func (t *MemoryTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+	})
+	return nil
+}
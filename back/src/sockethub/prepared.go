@@ -0,0 +1,59 @@
+package sockethub
+
+import (
+	"github.com/gorilla/websocket"
+	"sync"
+)
+
+// PreparedMessage is a message sent to many clients, websocket connections
+// share a single encoding of its frame instead of framing it once each.
+type PreparedMessage struct {
+	data []byte
+	// events are the messages data wraps, see NewBatchMessage.
+	events [][]byte
+
+	once sync.Once
+	ws   *websocket.PreparedMessage
+	err  error
+
+	sizeOnce sync.Once
+	size     int
+}
+
+// NewPreparedMessage wraps data, which must not be modified afterwards.
+func NewPreparedMessage(data []byte) *PreparedMessage {
+	return &PreparedMessage{data: data}
+}
+
+// NewBatchMessage wraps data made of events like EmitBatch, neither must be
+// modified afterwards.
+func NewBatchMessage(data []byte, events [][]byte) *PreparedMessage {
+	return &PreparedMessage{data: data, events: events}
+}
+
+func (p *PreparedMessage) Data() []byte {
+	return p.data
+}
+
+// websocket frames the message the first time a websocket connection sends it.
+func (p *PreparedMessage) websocket() (*websocket.PreparedMessage, error) {
+	p.once.Do(func() {
+		p.ws, p.err = websocket.NewPreparedMessage(websocket.BinaryMessage, p.data)
+	})
+	return p.ws, p.err
+}
+
+// compressedSize caches compressedSize, a message is only sent by one hub so
+// level is always the same.
+func (p *PreparedMessage) compressedSize(level int) int {
+	p.sizeOnce.Do(func() {
+		p.size = compressedSize(p.data, level)
+	})
+	return p.size
+}
+
+// preparedWriter is implemented by connections that can reuse the framing
+// of a PreparedMessage, the others are given its data.
+type preparedWriter interface {
+	WritePrepared(message *PreparedMessage) error
+}
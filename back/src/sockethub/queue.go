@@ -0,0 +1,204 @@
+package sockethub
+
+import (
+	"errors"
+	"sync"
+)
+
+// OverflowPolicy decides what happens to a message emitted to a client whose
+// send queue is already full.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest queued message to make room.
+	DropOldest OverflowPolicy = iota
+	// Coalesce replaces a queued message that has the same key, falling back
+	// to DropOldest for messages without a queued counterpart.
+	Coalesce
+	// Disconnect closes the connection of a client that cannot keep up.
+	Disconnect
+)
+
+// Priority selects the lane of a client's send queue a message waits in,
+// queued high priority messages are written before any normal ones.
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+	priorityLanes
+)
+
+// takeLimit bounds the normal priority messages taken at once, so that a high
+// priority message emitted meanwhile waits for at most that many writes.
+const takeLimit = 16
+
+var (
+	ErrClosed       = errors.New("connection is closed")
+	ErrSlowConsumer = errors.New("send queue is full")
+	// ErrUnknownClient is returned by Hub.EmitToClient for ids of clients
+	// that are not registered.
+	ErrUnknownClient = errors.New("unknown client")
+)
+
+type outMessage struct {
+	key  string
+	data []byte
+	// prepared is set for broadcasts, data is then its payload.
+	prepared *PreparedMessage
+	// events are the messages data wraps, see EmitBatch.
+	events   [][]byte
+	priority Priority
+}
+
+// compressedSize returns the size of the message compressed at level, a
+// broadcast is only compressed once for all its recipients.
+func (m outMessage) compressedSize(level int) int {
+	if m.prepared != nil {
+		return m.prepared.compressedSize(level)
+	}
+	return compressedSize(m.data, level)
+}
+
+// closeFrame is written once the queue has been flushed by finish.
+type closeFrame struct {
+	code   int
+	reason string
+}
+
+// sendQueue holds the messages waiting to be written to a client in a FIFO
+// lane per priority, size bounds the lanes together.
+type sendQueue struct {
+	mu        sync.Mutex
+	lanes     [priorityLanes][]outMessage
+	size      int
+	policy    OverflowPolicy
+	closed    bool
+	farewell  *closeFrame
+	ready     chan struct{}
+	dropped   uint64
+	coalesced uint64
+}
+
+func newSendQueue(size int, policy OverflowPolicy) *sendQueue {
+	return &sendQueue{size: size, policy: policy, ready: make(chan struct{}, 1)}
+}
+
+func (q *sendQueue) push(message outMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	lane := q.lanes[message.priority]
+	if q.policy == Coalesce && message.key != "" {
+		for i := range lane {
+			if lane[i].key == message.key {
+				lane[i] = message
+				q.coalesced++
+				return nil
+			}
+		}
+	}
+	if q.len() >= q.size {
+		q.dropped++
+		if q.policy == Disconnect {
+			return ErrSlowConsumer
+		}
+		q.dropOldest()
+	}
+	q.lanes[message.priority] = append(q.lanes[message.priority], message)
+	q.signal()
+	return nil
+}
+
+// dropOldest discards the oldest normal priority message, or the oldest high
+// priority one when there are only those.
+func (q *sendQueue) dropOldest() {
+	for _, priority := range []Priority{PriorityNormal, PriorityHigh} {
+		lane := q.lanes[priority]
+		if len(lane) == 0 {
+			continue
+		}
+		copy(lane, lane[1:])
+		q.lanes[priority] = lane[:len(lane)-1]
+		return
+	}
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take removes and returns the queued high priority messages followed by up
+// to takeLimit normal ones. closed reports whether the queue was closed and
+// is now empty, in which case no more messages will follow and farewell is
+// the close frame to send, if any. The ready channel is signalled whenever
+// there may be something to take.
+func (q *sendQueue) take() (messages []outMessage, closed bool, farewell *closeFrame) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	high, normal := q.lanes[PriorityHigh], q.lanes[PriorityNormal]
+	n := len(normal)
+	if n > takeLimit {
+		n = takeLimit
+	}
+	messages = make([]outMessage, 0, len(high)+n)
+	messages = append(messages, high...)
+	messages = append(messages, normal[:n]...)
+	q.lanes[PriorityHigh] = high[:0]
+	q.lanes[PriorityNormal] = append(normal[:0], normal[n:]...)
+	if len(q.lanes[PriorityNormal]) > 0 {
+		if !q.closed {
+			q.signal()
+		}
+		return messages, false, nil
+	}
+	return messages, q.closed, q.farewell
+}
+
+func (q *sendQueue) len() int {
+	return len(q.lanes[PriorityHigh]) + len(q.lanes[PriorityNormal])
+}
+
+// close stops the queue and discards the messages it still holds.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.lanes = [priorityLanes][]outMessage{}
+	q.farewell = nil
+	if q.closed {
+		return
+	}
+	q.closed = true
+	close(q.ready)
+}
+
+// finish stops the queue but keeps the messages it holds, so that they are
+// still sent, followed by farewell.
+func (q *sendQueue) finish(farewell *closeFrame) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.farewell = farewell
+	close(q.ready)
+}
+
+func (q *sendQueue) stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{Queued: q.len(), Dropped: q.dropped, Coalesced: q.coalesced}
+}
+
+// QueueStats describes the outbound queue of a client.
+type QueueStats struct {
+	Queued    int
+	Dropped   uint64
+	Coalesced uint64
+}
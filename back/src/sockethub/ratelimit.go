@@ -0,0 +1,254 @@
+package sockethub
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitAction decides what happens to a client sending an event faster
+// than its RateLimit allows.
+type RateLimitAction int
+
+const (
+	// RateLimitDrop discards the message, the client is logged at most once
+	// per dropLogInterval.
+	RateLimitDrop RateLimitAction = iota
+	// RateLimitWarn logs the client and handles the message anyway.
+	RateLimitWarn
+	// RateLimitDisconnect closes the connection.
+	RateLimitDisconnect
+	// RateLimitBan closes the connection and refuses new connections from the
+	// same IP for the hub's BanDuration.
+	RateLimitBan
+)
+
+// RateLimit is a token bucket: up to Burst messages are accepted at once and
+// the bucket refills at Rate messages per second.
+type RateLimit struct {
+	Rate   float64
+	Burst  int
+	Action RateLimitAction
+}
+
+// dropLogInterval bounds how often a client whose messages are dropped is
+// logged, a flooding client would otherwise flood the log too.
+const dropLogInterval = 10 * time.Second
+
+// Messages are rate limited by their first byte, which is the event of every
+// csbin message built on GenericSchema.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds the buckets of a single client, it is only used from the
+// client's reader goroutine.
+type rateLimiter struct {
+	limits     map[byte]RateLimit
+	fallback   *RateLimit
+	buckets    map[byte]*tokenBucket
+	violations uint64
+	// lastDropLog is when dropped messages were last logged.
+	lastDropLog time.Time
+}
+
+func newRateLimiter(config Config) *rateLimiter {
+	if len(config.RateLimits) == 0 && config.DefaultRateLimit == nil {
+		return nil
+	}
+	return &rateLimiter{
+		limits:   config.RateLimits,
+		fallback: config.DefaultRateLimit,
+		buckets:  make(map[byte]*tokenBucket),
+	}
+}
+
+// allow takes a token for the event of data, ok is false when the bucket
+// was empty and action tells what to do about it.
+func (r *rateLimiter) allow(data []byte, now time.Time) (ok bool, action RateLimitAction) {
+	if len(data) == 0 {
+		return true, RateLimitDrop
+	}
+	event := data[0]
+	limit, found := r.limits[event]
+	if !found {
+		if r.fallback == nil {
+			return true, RateLimitDrop
+		}
+		limit = *r.fallback
+	}
+	bucket, found := r.buckets[event]
+	if !found {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		r.buckets[event] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * limit.Rate
+	if bucket.tokens > float64(limit.Burst) {
+		bucket.tokens = float64(limit.Burst)
+	}
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, RateLimitDrop
+	}
+	r.violations++
+	return false, limit.Action
+}
+
+// banList remembers IPs banned by RateLimitBan until their ban expires.
+type banList struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func newBanList() *banList {
+	return &banList{until: make(map[string]time.Time)}
+}
+
+// ban also forgets the expired bans, which are otherwise only removed when
+// their host connects again.
+func (b *banList) ban(host string, duration time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for banned, until := range b.until {
+		if now.After(until) {
+			delete(b.until, banned)
+		}
+	}
+	b.until[host] = now.Add(duration)
+}
+
+func (b *banList) banned(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.until[host]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(b.until, host)
+		return false
+	}
+	return true
+}
+
+// hostOf returns the IP of addr, or the whole address for transports without
+// ports such as Unix sockets and pipes.
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// proxyList matches the addresses of Config.TrustedProxies.
+type proxyList []*net.IPNet
+
+func newProxyList(addrs []string) proxyList {
+	var proxies proxyList
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				log.Printf("ignoring invalid trusted proxy %q", addr)
+				continue
+			}
+			bits := 8 * len(ip)
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			log.Printf("ignoring invalid trusted proxy %q: %v", addr, err)
+			continue
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies
+}
+
+func (p proxyList) trusted(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientHost returns the IP bans apply to for conn: its remote address, or
+// when it comes from a trusted proxy the last X-Forwarded-For address not
+// belonging to one, since the proxies append the address they got the
+// request from.
+func (h *Hub) clientHost(conn Conn) string {
+	host := hostOf(conn.RemoteAddr())
+	fwd, ok := conn.(forwarded)
+	if !ok || !h.proxies.trusted(host) {
+		return host
+	}
+	addrs := fwd.ForwardedFor()
+	for i := len(addrs) - 1; i >= 0; i-- {
+		host = addrs[i]
+		if !h.proxies.trusted(host) {
+			break
+		}
+	}
+	return host
+}
+
+// Ban refuses connections from host, an IP address, for duration.
+func (h *Hub) Ban(host string, duration time.Duration) {
+	h.bans.ban(host, duration)
+}
+
+// IsBanned reports whether connections from host are currently refused.
+func (h *Hub) IsBanned(host string) bool {
+	return h.bans.banned(host)
+}
+
+// rateLimit applies the client's rate limits to data and returns whether it
+// should be handled and whether the client should stay connected.
+func (conn *Client) rateLimit(data []byte) (handle bool, keep bool) {
+	if conn.limiter == nil {
+		return true, true
+	}
+	now := time.Now()
+	ok, action := conn.limiter.allow(data, now)
+	if ok {
+		return true, true
+	}
+	addr := conn.host
+	event := data[0]
+	switch action {
+	case RateLimitDrop:
+		if now.Sub(conn.limiter.lastDropLog) >= dropLogInterval {
+			conn.limiter.lastDropLog = now
+			log.Printf("dropping event %d from %v over its rate limit (%d violations)", event, addr, conn.limiter.violations)
+		}
+		return false, true
+	case RateLimitWarn:
+		log.Printf("rate limit exceeded for event %d by %v (%d violations)", event, addr, conn.limiter.violations)
+		return true, true
+	case RateLimitDisconnect:
+		log.Printf("disconnecting %v for exceeding the rate limit of event %d", addr, event)
+		return false, false
+	case RateLimitBan:
+		duration := conn.hub.config.BanDuration
+		log.Printf("banning %v for %v for exceeding the rate limit of event %d", addr, duration, event)
+		conn.hub.Ban(addr, duration)
+		return false, false
+	}
+	return false, true
+}
@@ -0,0 +1,56 @@
+package sockethub
+
+// DisconnectReason tells OnDisconnect callbacks why a client went away.
+type DisconnectReason int32
+
+const (
+	// ReasonClosed means the client closed the connection itself.
+	ReasonClosed DisconnectReason = iota
+	// ReasonTimeout means the client stopped answering pings or went idle.
+	ReasonTimeout
+	// ReasonSlowConsumer means the client's send queue overflowed under the
+	// Disconnect policy.
+	ReasonSlowConsumer
+	// ReasonReadError means reading from the socket failed.
+	ReasonReadError
+	// ReasonWriteError means writing to the socket failed.
+	ReasonWriteError
+	// ReasonServer means the application closed the client.
+	ReasonServer
+	// ReasonOverload means the client's inbound queue overflowed under the
+	// InboundDisconnect policy.
+	ReasonOverload
+	// ReasonRateLimited means the client broke a rate limit whose action is
+	// RateLimitDisconnect or RateLimitBan.
+	ReasonRateLimited
+	// ReasonShutdown means the hub was shut down.
+	ReasonShutdown
+	// ReasonMessageTooBig means the client sent a message over the read limit.
+	ReasonMessageTooBig
+)
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case ReasonClosed:
+		return "closed"
+	case ReasonTimeout:
+		return "timeout"
+	case ReasonSlowConsumer:
+		return "slow consumer"
+	case ReasonReadError:
+		return "read error"
+	case ReasonWriteError:
+		return "write error"
+	case ReasonServer:
+		return "closed by server"
+	case ReasonOverload:
+		return "overload"
+	case ReasonRateLimited:
+		return "rate limited"
+	case ReasonShutdown:
+		return "shutdown"
+	case ReasonMessageTooBig:
+		return "message too big"
+	}
+	return "unknown"
+}
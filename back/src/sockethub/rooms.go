@@ -0,0 +1,123 @@
+package sockethub
+
+import (
+	"sort"
+	"sync"
+)
+
+// roomIndex maps every room to its members, so that broadcasts only visit the
+// clients in the target rooms. The rooms set of each Client is guarded by the
+// same lock.
+type roomIndex struct {
+	mu      sync.RWMutex
+	members map[string]map[*Client]struct{}
+}
+
+func newRoomIndex() *roomIndex {
+	return &roomIndex{members: make(map[string]map[*Client]struct{})}
+}
+
+func (r *roomIndex) join(client *Client, room string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// a closed client has been or is about to be removed by leaveAll, adding
+	// it back would keep it in the index forever
+	if client.IsClosed() {
+		return
+	}
+	members, ok := r.members[room]
+	if !ok {
+		members = make(map[*Client]struct{})
+		r.members[room] = members
+	}
+	members[client] = struct{}{}
+	if client.rooms == nil {
+		client.rooms = make(map[string]struct{})
+	}
+	client.rooms[room] = struct{}{}
+}
+
+func (r *roomIndex) leave(client *Client, room string) {
+	r.mu.Lock()
+	r.remove(client, room)
+	r.mu.Unlock()
+}
+
+func (r *roomIndex) leaveAll(client *Client) {
+	r.mu.Lock()
+	for room := range client.rooms {
+		r.remove(client, room)
+	}
+	r.mu.Unlock()
+}
+
+func (r *roomIndex) remove(client *Client, room string) {
+	delete(client.rooms, room)
+	members := r.members[room]
+	delete(members, client)
+	if len(members) == 0 {
+		delete(r.members, room)
+	}
+}
+
+func (r *roomIndex) has(client *Client, room string) bool {
+	r.mu.RLock()
+	_, ok := client.rooms[room]
+	r.mu.RUnlock()
+	return ok
+}
+
+func (r *roomIndex) roomsOf(client *Client) []string {
+	r.mu.RLock()
+	res := make([]string, 0, len(client.rooms))
+	for room := range client.rooms {
+		res = append(res, room)
+	}
+	r.mu.RUnlock()
+	sort.Strings(res)
+	return res
+}
+
+// clients returns the members of any of the given rooms, each client once,
+// leaving out except.
+func (r *roomIndex) clients(rooms []string, except *Client) []*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(rooms) == 1 {
+		res := make([]*Client, 0, len(r.members[rooms[0]]))
+		for client := range r.members[rooms[0]] {
+			if client != except {
+				res = append(res, client)
+			}
+		}
+		return res
+	}
+	seen := make(map[*Client]struct{})
+	var res []*Client
+	for _, room := range rooms {
+		for client := range r.members[room] {
+			if _, ok := seen[client]; ok || client == except {
+				continue
+			}
+			seen[client] = struct{}{}
+			res = append(res, client)
+		}
+	}
+	return res
+}
+
+func (r *roomIndex) count(room string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.members[room])
+}
+
+func (r *roomIndex) counts() map[string]int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make(map[string]int, len(r.members))
+	for room, members := range r.members {
+		res[room] = len(members)
+	}
+	return res
+}
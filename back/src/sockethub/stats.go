@@ -0,0 +1,189 @@
+package sockethub
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventTraffic counts the messages of one event, their first byte, exchanged
+// with a client. Bytes are message payloads, before framing. Events sent in a
+// batch, see EmitBatch, are counted on their own, leaving out the bytes of
+// the batch itself.
+type EventTraffic struct {
+	MessagesIn  uint64
+	BytesIn     uint64
+	MessagesOut uint64
+	BytesOut    uint64
+}
+
+func (t *EventTraffic) add(other EventTraffic) {
+	t.MessagesIn += other.MessagesIn
+	t.BytesIn += other.BytesIn
+	t.MessagesOut += other.MessagesOut
+	t.BytesOut += other.BytesOut
+}
+
+// traffic is updated by the reader and the writer of a client, and read by
+// Stats from anywhere.
+type traffic struct {
+	mu     sync.Mutex
+	events map[byte]*EventTraffic
+}
+
+func newTraffic() *traffic {
+	return &traffic{events: make(map[byte]*EventTraffic)}
+}
+
+func (t *traffic) event(data []byte) *EventTraffic {
+	var event byte
+	if len(data) > 0 {
+		event = data[0]
+	}
+	stats, ok := t.events[event]
+	if !ok {
+		stats = &EventTraffic{}
+		t.events[event] = stats
+	}
+	return stats
+}
+
+func (t *traffic) received(data []byte) {
+	t.mu.Lock()
+	stats := t.event(data)
+	stats.MessagesIn++
+	stats.BytesIn += uint64(len(data))
+	t.mu.Unlock()
+}
+
+// sent counts data, or the events it wraps when there are any.
+func (t *traffic) sent(data []byte, events [][]byte) {
+	t.mu.Lock()
+	if len(events) == 0 {
+		events = [][]byte{data}
+	}
+	for _, event := range events {
+		stats := t.event(event)
+		stats.MessagesOut++
+		stats.BytesOut += uint64(len(event))
+	}
+	t.mu.Unlock()
+}
+
+func (t *traffic) snapshot() map[byte]EventTraffic {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := make(map[byte]EventTraffic, len(t.events))
+	for event, stats := range t.events {
+		result[event] = *stats
+	}
+	return result
+}
+
+// rtt measures round trips from the heartbeat pings, which are answered by
+// the peer's transport without involving the application.
+type rtt struct {
+	// UnixNano times and durations, accessed atomically.
+	pingSent int64
+	last     int64
+	smoothed int64
+}
+
+// ping stamps a heartbeat ping unless one is still waiting for its pong, so
+// that a peer slow to answer isn't measured from a later ping.
+func (r *rtt) ping(now time.Time) {
+	atomic.CompareAndSwapInt64(&r.pingSent, 0, now.UnixNano())
+}
+
+func (r *rtt) pong(now time.Time) {
+	sent := atomic.SwapInt64(&r.pingSent, 0)
+	if sent == 0 {
+		return
+	}
+	sample := now.UnixNano() - sent
+	atomic.StoreInt64(&r.last, sample)
+	// smoothed like TCP's SRTT, with a gain of 1/8
+	smoothed := atomic.LoadInt64(&r.smoothed)
+	if smoothed == 0 {
+		smoothed = sample
+	} else {
+		smoothed += (sample - smoothed) / 8
+	}
+	atomic.StoreInt64(&r.smoothed, smoothed)
+}
+
+// ClientStats is a snapshot of a client's connection.
+type ClientStats struct {
+	ID          string
+	RemoteAddr  string
+	ConnectedAt time.Time
+	Rooms       []string
+	// RTT is the last round trip measured from heartbeat pings and
+	// SmoothedRTT their moving average, both are zero until the first pong.
+	RTT         time.Duration
+	SmoothedRTT time.Duration
+	// Events is keyed by the first byte of the messages.
+	Events  map[byte]EventTraffic
+	Send    QueueStats
+	Inbound QueueStats
+}
+
+// Total sums the traffic of every event.
+func (s ClientStats) Total() EventTraffic {
+	var total EventTraffic
+	for _, traffic := range s.Events {
+		total.add(traffic)
+	}
+	return total
+}
+
+// HubStats is a snapshot of every client registered with a hub.
+type HubStats struct {
+	// Clients is sorted by ID.
+	Clients []ClientStats
+	// Events sums the traffic of the clients per event.
+	Events map[byte]EventTraffic
+}
+
+// Stats returns a snapshot of the client's traffic and queues.
+func (conn *Client) Stats() ClientStats {
+	return ClientStats{
+		ID:          conn.id,
+		RemoteAddr:  conn.socket.RemoteAddr().String(),
+		ConnectedAt: conn.connectedAt,
+		Rooms:       conn.Rooms(),
+		RTT:         time.Duration(atomic.LoadInt64(&conn.rtt.last)),
+		SmoothedRTT: time.Duration(atomic.LoadInt64(&conn.rtt.smoothed)),
+		Events:      conn.traffic.snapshot(),
+		Send:        conn.QueueStats(),
+		Inbound:     conn.InboundStats(),
+	}
+}
+
+// Stats returns a snapshot of every registered client.
+func (h *Hub) Stats() HubStats {
+	h.mu.Lock()
+	clients := make([]*Client, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mu.Unlock()
+	stats := HubStats{
+		Clients: make([]ClientStats, 0, len(clients)),
+		Events:  make(map[byte]EventTraffic),
+	}
+	for _, client := range clients {
+		clientStats := client.Stats()
+		stats.Clients = append(stats.Clients, clientStats)
+		for event, traffic := range clientStats.Events {
+			total := stats.Events[event]
+			total.add(traffic)
+			stats.Events[event] = total
+		}
+	}
+	sort.Slice(stats.Clients, func(i, j int) bool {
+		return stats.Clients[i].ID < stats.Clients[j].ID
+	})
+	return stats
+}
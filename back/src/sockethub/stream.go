@@ -0,0 +1,356 @@
+package sockethub
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MaxStreamMessageSize bounds the payload of a single stream frame, larger
+// frames are rejected before anything is allocated for them.
+const MaxStreamMessageSize = 16 << 20
+
+// Stream frames start with a one byte kind followed by the big-endian uint32
+// payload length, data frames carry csbin messages exactly as websocket
+// binary messages do.
+const streamHeaderSize = 5
+
+type streamFrameKind uint8
+
+const (
+	streamData streamFrameKind = iota
+	streamPing
+	streamPong
+	streamClose
+	// streamAuth is the first frame sent to a StreamTransport with an
+	// Authenticator, it carries the client's bearer token.
+	streamAuth
+)
+
+// streamHandshakeTimeout bounds the wait for the streamAuth frame.
+const streamHandshakeTimeout = 10 * time.Second
+
+// maxStreamCredentialSize bounds the payload of the streamAuth frame.
+const maxStreamCredentialSize = 4 << 10
+
+var errStreamFrameTooLarge = errors.New("stream frame is too large")
+
+type streamConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	header [streamHeaderSize]byte
+	// identity is nil for connections that were not authenticated.
+	identity *Identity
+
+	// readLimit is only used by ReadMessage, zero leaves frames bounded by
+	// MaxStreamMessageSize only.
+	readLimit int64
+
+	writeMu     sync.Mutex
+	writeHeader [streamHeaderSize]byte
+	// closeSent is set once a close frame has been written, the peer stops
+	// reading at the first one.
+	closeSent bool
+
+	pongMu sync.Mutex
+	onPong func()
+}
+
+// NewStreamConn speaks the length-prefixed stream protocol over conn, for
+// clients connecting over TCP or Unix domain sockets.
+func NewStreamConn(conn net.Conn) Conn {
+	return &streamConn{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// DialStream connects to a StreamTransport, network is "tcp" or "unix".
+func DialStream(network, address string) (Conn, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamConn(conn), nil
+}
+
+// DialStreamWithToken connects to a StreamTransport requiring authentication,
+// token is checked by its Authenticator as a bearer token.
+func DialStreamWithToken(network, address, token string) (Conn, error) {
+	conn, err := DialStream(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.(*streamConn).writeFrame(streamAuth, []byte(token)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *streamConn) Identity() *Identity {
+	return c.identity
+}
+
+func (c *streamConn) ReadMessage() ([]byte, error) {
+	for {
+		if _, err := io.ReadFull(c.reader, c.header[:]); err != nil {
+			return nil, err
+		}
+		kind := streamFrameKind(c.header[0])
+		size := binary.BigEndian.Uint32(c.header[1:])
+		if size > MaxStreamMessageSize || (c.readLimit > 0 && int64(size) > c.readLimit) {
+			c.WriteClose(CloseMessageTooBig, "")
+			return nil, ErrMessageTooBig
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		switch kind {
+		case streamData:
+			return data, nil
+		case streamPing:
+			if err := c.writeFrame(streamPong, nil); err != nil {
+				return nil, err
+			}
+		case streamPong:
+			c.pongMu.Lock()
+			onPong := c.onPong
+			c.pongMu.Unlock()
+			if onPong != nil {
+				onPong()
+			}
+		case streamClose:
+			return nil, io.EOF
+		default:
+			return nil, fmt.Errorf("unknown stream frame kind %d", kind)
+		}
+	}
+}
+
+func (c *streamConn) writeFrame(kind streamFrameKind, data []byte) error {
+	if len(data) > MaxStreamMessageSize {
+		return errStreamFrameTooLarge
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if kind == streamClose {
+		if c.closeSent {
+			return nil
+		}
+		c.closeSent = true
+	}
+	c.writeHeader[0] = byte(kind)
+	binary.BigEndian.PutUint32(c.writeHeader[1:], uint32(len(data)))
+	buffers := net.Buffers{c.writeHeader[:], data}
+	_, err := buffers.WriteTo(c.conn)
+	return err
+}
+
+func (c *streamConn) WriteMessage(data []byte) error {
+	return c.writeFrame(streamData, data)
+}
+
+func (c *streamConn) WritePing() error {
+	return c.writeFrame(streamPing, nil)
+}
+
+// WriteClose sends a close frame carrying the big-endian uint16 code followed
+// by the reason.
+func (c *streamConn) WriteClose(code int, reason string) error {
+	data := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(data, uint16(code))
+	copy(data[2:], reason)
+	return c.writeFrame(streamClose, data)
+}
+
+func (c *streamConn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+func (c *streamConn) SetPongHandler(handler func()) {
+	c.pongMu.Lock()
+	c.onPong = handler
+	c.pongMu.Unlock()
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close tells the peer the connection is going away, unless WriteClose already
+// did, so that it sees a clean io.EOF, and closes the underlying connection.
+func (c *streamConn) Close() error {
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(streamClose, nil)
+	return c.conn.Close()
+}
+
+// readCredential reads the streamAuth frame a client opens the connection
+// with.
+func (c *streamConn) readCredential() (string, error) {
+	if _, err := io.ReadFull(c.reader, c.header[:]); err != nil {
+		return "", err
+	}
+	size := binary.BigEndian.Uint32(c.header[1:])
+	if streamFrameKind(c.header[0]) != streamAuth || size > maxStreamCredentialSize {
+		return "", ErrMissingCredentials
+	}
+	token := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, token); err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// StreamTransport accepts length-prefixed stream connections from a
+// net.Listener, letting bots and tools connect without an HTTP stack.
+type StreamTransport struct {
+	listener      net.Listener
+	authenticator Authenticator
+	conns         chan Conn
+	// acceptErr receives the error that stopped the accept loop.
+	acceptErr chan error
+	startOnce sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// ListenStream listens on a TCP or Unix domain socket address, see
+// net.Listen.
+func ListenStream(network, address string) (*StreamTransport, error) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamTransport(listener), nil
+}
+
+func NewStreamTransport(listener net.Listener) *StreamTransport {
+	return &StreamTransport{
+		listener:  listener,
+		conns:     make(chan Conn),
+		acceptErr: make(chan error, 1),
+		closed:    make(chan struct{}),
+	}
+}
+
+// SetAuthenticator makes clients open their connection with a bearer token,
+// see DialStreamWithToken, which authenticator checks as the Authorization
+// header of a request. Rejected connections are closed with
+// ClosePolicyViolation. It must be called before serving connections.
+func (t *StreamTransport) SetAuthenticator(authenticator Authenticator) {
+	t.authenticator = authenticator
+}
+
+func (t *StreamTransport) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Accept returns the next connection, authenticated ones are handed out in
+// the order they complete their handshake.
+func (t *StreamTransport) Accept() (Conn, error) {
+	t.startOnce.Do(func() {
+		go t.acceptLoop()
+	})
+	select {
+	case conn := <-t.conns:
+		return conn, nil
+	case err := <-t.acceptErr:
+		return nil, err
+	case <-t.closed:
+		return nil, ErrTransportClosed
+	}
+}
+
+// acceptLoop runs the handshakes on their own goroutines, so that a client
+// slow to send its token doesn't hold up the others.
+func (t *StreamTransport) acceptLoop() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.closed:
+				return
+			default:
+			}
+			if retryAccept(err) {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			t.acceptErr <- err
+			return
+		}
+		stream := NewStreamConn(conn).(*streamConn)
+		if t.authenticator == nil {
+			t.deliver(stream)
+			continue
+		}
+		go t.handshake(stream)
+	}
+}
+
+// retryAccept reports whether the listener may accept again after err, which
+// happens when the process runs out of file descriptors or a client hangs up
+// before being accepted.
+func retryAccept(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || errors.Is(err, syscall.ECONNABORTED)
+}
+
+func (t *StreamTransport) handshake(conn *streamConn) {
+	conn.SetReadDeadline(time.Now().Add(streamHandshakeTimeout))
+	token, err := conn.readCredential()
+	if err == nil {
+		r := &http.Request{Header: http.Header{}, URL: &url.URL{}}
+		r.Header.Set("Authorization", "Bearer "+token)
+		conn.identity, err = t.authenticator.Authenticate(r)
+	}
+	if err != nil {
+		log.Printf("rejecting connection from %s: %v", conn.RemoteAddr(), err)
+		conn.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.WriteClose(ClosePolicyViolation, err.Error())
+		conn.conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	t.deliver(conn)
+}
+
+func (t *StreamTransport) deliver(conn Conn) {
+	select {
+	case t.conns <- conn:
+	case <-t.closed:
+		conn.Close()
+	}
+}
+
+func (t *StreamTransport) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		err = t.listener.Close()
+	})
+	return err
+}
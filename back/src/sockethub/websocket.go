@@ -0,0 +1,204 @@
+package sockethub
+
+import (
+	"github.com/gorilla/websocket"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type websocketConn struct {
+	ws           *websocket.Conn
+	identity     *Identity
+	compressing  bool
+	forwardedFor []string
+}
+
+// NewWebsocketConn adapts a gorilla websocket connection to Conn. Only binary
+// messages are delivered, text messages are logged and dropped.
+func NewWebsocketConn(ws *websocket.Conn) Conn {
+	return &websocketConn{ws: ws}
+}
+
+func (c *websocketConn) Identity() *Identity {
+	return c.identity
+}
+
+func (c *websocketConn) ForwardedFor() []string {
+	return c.forwardedFor
+}
+
+func (c *websocketConn) Compressing() bool {
+	return c.compressing
+}
+
+func (c *websocketConn) EnableWriteCompression(enable bool) {
+	c.ws.EnableWriteCompression(enable)
+}
+
+func (c *websocketConn) SetCompressionLevel(level int) error {
+	return c.ws.SetCompressionLevel(level)
+}
+
+func (c *websocketConn) ReadMessage() ([]byte, error) {
+	for {
+		messageType, data, err := c.ws.ReadMessage()
+		if err == websocket.ErrReadLimit {
+			// gorilla has already sent CloseMessageTooBig
+			return nil, ErrMessageTooBig
+		}
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		if messageType != websocket.BinaryMessage {
+			log.Println("Expected BinaryMessage, got: ", messageType)
+			continue
+		}
+		return data, nil
+	}
+}
+
+func (c *websocketConn) SetReadLimit(limit int64) {
+	c.ws.SetReadLimit(limit)
+}
+
+func (c *websocketConn) WriteMessage(data []byte) error {
+	return c.ws.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (c *websocketConn) WritePrepared(message *PreparedMessage) error {
+	prepared, err := message.websocket()
+	if err != nil {
+		return err
+	}
+	return c.ws.WritePreparedMessage(prepared)
+}
+
+func (c *websocketConn) WritePing() error {
+	return c.ws.WriteMessage(websocket.PingMessage, nil)
+}
+
+func (c *websocketConn) WriteClose(code int, reason string) error {
+	return c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+}
+
+func (c *websocketConn) SetPongHandler(handler func()) {
+	c.ws.SetPongHandler(func(string) error {
+		handler()
+		return nil
+	})
+}
+
+func (c *websocketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *websocketConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *websocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *websocketConn) Close() error {
+	return c.ws.Close()
+}
+
+// WebsocketTransport is an http.Handler upgrading requests to websocket
+// connections, which are then handed out by Accept.
+type WebsocketTransport struct {
+	upgrader      websocket.Upgrader
+	authenticator Authenticator
+	conns         chan Conn
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+func NewWebsocketTransport(upgrader websocket.Upgrader) *WebsocketTransport {
+	return &WebsocketTransport{upgrader: upgrader, conns: make(chan Conn), closed: make(chan struct{})}
+}
+
+// SetAuthenticator makes the transport check every request with
+// authenticator before upgrading it, rejected requests are answered with the
+// status of the AuthError. It must be called before serving requests.
+func (t *WebsocketTransport) SetAuthenticator(authenticator Authenticator) {
+	t.authenticator = authenticator
+}
+
+func (t *WebsocketTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var identity *Identity
+	if t.authenticator != nil {
+		var err error
+		identity, err = t.authenticator.Authenticate(r)
+		if err != nil {
+			log.Printf("rejecting connection from %s: %v", r.RemoteAddr, err)
+			http.Error(w, err.Error(), authStatus(err))
+			return
+		}
+	}
+	ws, err := t.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	conn := &websocketConn{
+		ws:           ws,
+		identity:     identity,
+		compressing:  t.upgrader.EnableCompression && offersDeflate(r),
+		forwardedFor: forwardedFor(r),
+	}
+	select {
+	case t.conns <- conn:
+	case <-t.closed:
+		ws.Close()
+	}
+}
+
+func (t *WebsocketTransport) Accept() (Conn, error) {
+	select {
+	case conn := <-t.conns:
+		return conn, nil
+	case <-t.closed:
+		return nil, ErrTransportClosed
+	}
+}
+
+// Close stops handing out connections, upgrades still in flight are closed.
+func (t *WebsocketTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+	})
+	return nil
+}
+
+// offersDeflate reports whether the client offered permessage-deflate, which
+// the upgrader then accepts when compression is enabled.
+func offersDeflate(r *http.Request) bool {
+	for _, extensions := range r.Header["Sec-Websocket-Extensions"] {
+		if strings.Contains(extensions, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor splits the X-Forwarded-For headers of r into addresses.
+func forwardedFor(r *http.Request) []string {
+	var addrs []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, addr := range strings.Split(header, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,74 @@
+package tests
+
+import (
+	"github.com/diyor28/not-agar/src/sockethub"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWebsocketAuthentication(t *testing.T) {
+	auth := sockethub.NewTokenAuth([]byte("secret"))
+	// origins are checked by OriginAuth instead of the upgrader
+	transport := sockethub.NewWebsocketTransport(websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	})
+	transport.SetAuthenticator(sockethub.AllOf(
+		&sockethub.OriginAuth{Allowed: []string{"http://game.example"}},
+		auth,
+	))
+	hub := sockethub.NewHub()
+	connected := make(chan *sockethub.Client, 1)
+	hub.OnConnect(func(client *sockethub.Client) {
+		connected <- client
+	})
+	url := serveWebsocket(t, hub, transport)
+
+	dial := func(query string, origin string) (*websocket.Conn, int) {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url+query, header)
+		if err != nil {
+			if resp == nil {
+				t.Fatal(err)
+			}
+			return nil, resp.StatusCode
+		}
+		return conn, resp.StatusCode
+	}
+
+	cases := []struct {
+		name   string
+		query  string
+		origin string
+		status int
+	}{
+		{"missing token", "", "http://game.example", http.StatusUnauthorized},
+		{"forged token", "?token=" + sockethub.NewTokenAuth([]byte("other")).Issue("bob", time.Minute), "", http.StatusUnauthorized},
+		{"expired token", "?token=" + auth.Issue("bob", -time.Minute), "", http.StatusUnauthorized},
+		{"foreign origin", "?token=" + auth.Issue("bob", time.Minute), "http://evil.example", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		if conn, status := dial(c.query, c.origin); conn != nil || status != c.status {
+			t.Errorf("%s: got status %d, expected %d", c.name, status, c.status)
+		}
+	}
+
+	conn, status := dial("?token="+auth.Issue("alice", time.Minute), "http://game.example")
+	if conn == nil {
+		t.Fatalf("valid token rejected with %d", status)
+	}
+	defer conn.Close()
+	select {
+	case client := <-connected:
+		identity := client.Identity()
+		if identity == nil || identity.Subject != "alice" || identity.Method != "token" {
+			t.Fatalf("unexpected identity %+v", identity)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnConnect was not called")
+	}
+}
@@ -0,0 +1,47 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/diyor28/not-agar/src/gamengine/constants"
+	"github.com/diyor28/not-agar/src/gamengine/schemas"
+	"testing"
+)
+
+func TestBatchEncode(t *testing.T) {
+	writer, err := schemas.EncodeBatch([][]byte{{byte(constants.Rip)}, {byte(constants.FoodEaten), 0, 0, 0, 7}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	hexString := hex.EncodeToString(writer.Bytes())
+	if hexString != "0b0002000000010a000000050600000007" {
+		t.Errorf("expected: 0b0002000000010a000000050600000007 \ngot: %s", hexString)
+	}
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	messages := [][]byte{{byte(constants.Rip)}, {}, bytes.Repeat([]byte{byte(constants.Moved)}, 300)}
+	writer, err := schemas.EncodeBatch(messages)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	decoded, err := schemas.DecodeBatch(writer.Bytes())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(decoded) != len(messages) {
+		t.Errorf("expected %d messages, got %d", len(messages), len(decoded))
+		return
+	}
+	for i := range messages {
+		if !bytes.Equal(decoded[i], messages[i]) {
+			t.Errorf("message %d: expected: %v, got: %v", i, messages[i], decoded[i])
+		}
+	}
+	if _, err := schemas.DecodeBatch(writer.Bytes()[:len(writer.Bytes())-1]); err == nil {
+		t.Error("expected an error for a truncated batch")
+	}
+}
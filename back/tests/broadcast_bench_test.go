@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"github.com/diyor28/not-agar/src/sockethub"
+	"github.com/gorilla/websocket"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+const broadcastClients = 200
+
+// broadcastWindow stays below the send queue size, see broadcastHub.
+const broadcastWindow = 64
+
+// broadcastHub connects broadcastClients websocket clients to a hub, all in
+// the "players" room, and returns them with a WaitGroup that is done once
+// per message each of them receives.
+func broadcastHub(b *testing.B, compress bool) (*sockethub.Hub, *sync.WaitGroup) {
+	config := sockethub.DefaultConfig()
+	config.SendQueueSize = 1024
+	hub := sockethub.NewHubWithConfig(config)
+	connected := make(chan struct{}, broadcastClients)
+	hub.OnConnect(func(client *sockethub.Client) {
+		client.Join("players")
+		connected <- struct{}{}
+	})
+	url := serveWebsocket(b, hub, sockethub.NewWebsocketTransport(websocket.Upgrader{EnableCompression: compress}))
+
+	received := &sync.WaitGroup{}
+	dialer := websocket.Dialer{EnableCompression: compress}
+	for i := 0; i < broadcastClients; i++ {
+		conn, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() {
+			conn.Close()
+		})
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+				received.Done()
+			}
+		}()
+		<-connected
+	}
+	return hub, received
+}
+
+// foodPayload looks like a FoodCreated event, repetitive enough to compress.
+func foodPayload() []byte {
+	data := make([]byte, 16<<10)
+	for i := range data {
+		data[i] = byte(rand.Intn(16))
+	}
+	return data
+}
+
+// BenchmarkBroadcast sends the same payload to every client, either emitting
+// it to each of them or letting the hub frame it once.
+func BenchmarkBroadcast(b *testing.B) {
+	broadcasts := []struct {
+		name string
+		send func(hub *sockethub.Hub, data []byte)
+	}{
+		{"Emit", func(hub *sockethub.Hub, data []byte) {
+			for _, client := range hub.InRoom("players") {
+				if err := client.Emit(data); err != nil {
+					panic(err)
+				}
+			}
+		}},
+		{"Prepared", func(hub *sockethub.Hub, data []byte) {
+			hub.EmitTo(data, "players")
+		}},
+	}
+	for _, compress := range []bool{false, true} {
+		framing := "plain"
+		if compress {
+			framing = "deflate"
+		}
+		for _, broadcast := range broadcasts {
+			broadcast := broadcast
+			b.Run(framing+"/"+broadcast.name, func(b *testing.B) {
+				hub, received := broadcastHub(b, compress)
+				data := foodPayload()
+				b.ReportAllocs()
+				b.SetBytes(int64(len(data)))
+				b.ResetTimer()
+				// a few broadcasts are in flight at once so that the
+				// benchmark is bound by the work done per broadcast rather
+				// than by latency
+				for n := 0; n < b.N; n++ {
+					received.Add(broadcastClients)
+					broadcast.send(hub, data)
+					if n%broadcastWindow == broadcastWindow-1 {
+						received.Wait()
+					}
+				}
+				received.Wait()
+			})
+		}
+	}
+}
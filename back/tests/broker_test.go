@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"github.com/diyor28/not-agar/src/sockethub"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// brokerClient connects a client to a hub sharing the "global" room through
+// broker, the client is in "global" and "local".
+func brokerClient(t *testing.T, broker sockethub.Broker) (*sockethub.Hub, sockethub.Conn) {
+	hub := sockethub.NewHub()
+	connected := make(chan struct{})
+	hub.OnConnect(func(client *sockethub.Client) {
+		client.Join("global")
+		client.Join("local")
+		close(connected)
+	})
+	hub.UseBroker(broker, "global")
+	transport := sockethub.NewMemoryTransport()
+	serveHub(t, hub, transport)
+	conn, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	<-connected
+	return hub, conn
+}
+
+func expectMessage(t *testing.T, conn sockethub.Conn, want string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Fatalf("got %q, expected %q", data, want)
+	}
+}
+
+func testBroker(t *testing.T, first, second sockethub.Broker) {
+	hubA, connA := brokerClient(t, first)
+	hubB, connB := brokerClient(t, second)
+
+	hubA.EmitTo([]byte("from a"), "global")
+	expectMessage(t, connA, "from a")
+	expectMessage(t, connB, "from a")
+
+	// only shared rooms go through the broker
+	hubA.EmitTo([]byte("local"), "local")
+	expectMessage(t, connA, "local")
+	hubB.EmitTo([]byte("from b"), "global", "local")
+	expectMessage(t, connB, "from b")
+	expectMessage(t, connA, "from b")
+}
+
+func TestMemoryBroker(t *testing.T) {
+	broker := sockethub.NewMemoryBroker()
+	defer broker.Close()
+	testBroker(t, broker, broker)
+}
+
+func TestNetworkBroker(t *testing.T) {
+	server, err := sockethub.ListenBroker("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Close()
+	brokers := dialBrokers(t, "tcp", server.Addr().String())
+	waitPeers(t, server, len(brokers))
+	testBroker(t, brokers[0], brokers[1])
+}
+
+func dialBrokers(t *testing.T, network, address string) []*sockethub.NetworkBroker {
+	brokers := make([]*sockethub.NetworkBroker, 2)
+	for i := range brokers {
+		broker, err := sockethub.DialBroker(network, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			broker.Close()
+		})
+		brokers[i] = broker
+	}
+	return brokers
+}
+
+func waitPeers(t *testing.T, server *sockethub.BrokerServer, peers int) {
+	for deadline := time.Now().Add(5 * time.Second); server.Peers() < peers; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("brokers did not connect")
+		}
+	}
+}
+
+func TestNetworkBrokerReconnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "not-agar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	address := filepath.Join(dir, "broker.sock")
+	server, err := sockethub.ListenBroker("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	brokers := dialBrokers(t, "unix", address)
+	waitPeers(t, server, len(brokers))
+	server.Close()
+
+	// publishing while the server is gone neither blocks nor grows forever
+	message := sockethub.BrokerMessage{Rooms: []string{"elsewhere"}, Data: []byte("queued")}
+	done := make(chan error)
+	go func() {
+		var err error
+		for i := 0; i < 1000 && err == nil; i++ {
+			err = brokers[0].Publish(message)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != sockethub.ErrBrokerBacklog {
+			t.Fatalf("expected ErrBrokerBacklog, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Publish blocked while the server was gone")
+	}
+
+	server, err = sockethub.ListenBroker("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Close()
+	waitPeers(t, server, len(brokers))
+	// the backlog is sent first, to a room none of the clients are in
+	testBroker(t, brokers[0], brokers[1])
+}
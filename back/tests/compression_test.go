@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"bytes"
+	"github.com/diyor28/not-agar/src/sockethub"
+	"github.com/gorilla/websocket"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHubCompressionPolicy(t *testing.T) {
+	const snapshot, update = 1, 2
+	config := sockethub.DefaultConfig()
+	config.Compression = sockethub.CompressionPolicy{
+		MinSize: 64,
+		Events:  map[byte]bool{snapshot: true, update: false},
+	}
+	hub := sockethub.NewHubWithConfig(config)
+	connected := make(chan *sockethub.Client, 1)
+	hub.OnConnect(func(client *sockethub.Client) {
+		connected <- client
+	})
+	url := serveWebsocket(t, hub, sockethub.NewWebsocketTransport(websocket.Upgrader{EnableCompression: true}))
+	var received readCounter
+	dialer := websocket.Dialer{EnableCompression: true, NetDial: received.dial}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := <-connected
+
+	payload := func(event byte) []byte {
+		return append([]byte{event}, bytes.Repeat([]byte("food "), 400)...)
+	}
+	// frame sizes read by the peer, payload and header
+	frames := make(map[byte]int64)
+	for _, event := range []byte{snapshot, update} {
+		before := received.count()
+		if err := client.Emit(payload(event)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, payload(event)) {
+			t.Fatalf("event %d arrived corrupted", event)
+		}
+		frames[event] = received.count() - before
+	}
+
+	// the writer records a message once the write returns, which may be
+	// after it has been read
+	stats := hub.CompressionStats()
+	for deadline := time.Now().Add(time.Second); stats[update].Messages == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		stats = hub.CompressionStats()
+	}
+	compressed, plain := stats[snapshot], stats[update]
+	if compressed.Messages != 1 || compressed.Compressed != 1 || compressed.Ratio() > 0.2 {
+		t.Errorf("snapshot was not compressed: %+v", compressed)
+	}
+	if plain.Messages != 1 || plain.Compressed != 0 || plain.Ratio() != 1 {
+		t.Errorf("update was compressed: %+v", plain)
+	}
+	for event, stats := range map[byte]sockethub.CompressionStats{snapshot: compressed, update: plain} {
+		if header := frameHeader(stats.SentBytes); stats.SentBytes+header != uint64(frames[event]) {
+			t.Errorf("event %d counted as %d bytes, %d arrived with a %d bytes header", event, stats.SentBytes, frames[event], header)
+		}
+	}
+}
+
+// frameHeader returns the size of the header of an unmasked frame.
+func frameHeader(payload uint64) uint64 {
+	switch {
+	case payload < 126:
+		return 2
+	case payload < 1<<16:
+		return 4
+	}
+	return 10
+}
+
+// readCounter counts the bytes read from the connections it dials.
+type readCounter struct {
+	read int64
+}
+
+func (c *readCounter) dial(network, addr string) (net.Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, counter: c}, nil
+}
+
+func (c *readCounter) count() int64 {
+	return atomic.LoadInt64(&c.read)
+}
+
+type countingConn struct {
+	net.Conn
+	counter *readCounter
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.counter.read, int64(n))
+	return n, err
+}
@@ -0,0 +1,43 @@
+//go:build go1.18
+// +build go1.18
+
+package tests
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// The fuzz targets need go1.18's testing.F, the round-trip tests they share
+// their cases with run on any version.
+
+func fuzzDecode(f *testing.F, c schemaCase) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 4; i++ {
+		value := c.newValue()
+		fill(rnd, reflect.ValueOf(value).Elem())
+		if writer, err := c.schema.Encode(value); err == nil {
+			f.Add(writer.Bytes())
+		}
+	}
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_ = c.schema.Decode(data, c.newValue())
+		_ = c.schema.Decode(data, newMap())
+	})
+}
+
+func FuzzGenericSchemaDecode(f *testing.F)        { fuzzDecode(f, gameSchema("Generic")) }
+func FuzzPingPongSchemaDecode(f *testing.F)       { fuzzDecode(f, gameSchema("PingPong")) }
+func FuzzStartSchemaDecode(f *testing.F)          { fuzzDecode(f, gameSchema("Start")) }
+func FuzzStartedSchemaDecode(f *testing.F)        { fuzzDecode(f, gameSchema("Started")) }
+func FuzzMoveSchemaDecode(f *testing.F)           { fuzzDecode(f, gameSchema("Move")) }
+func FuzzMovedSchemaDecode(f *testing.F)          { fuzzDecode(f, gameSchema("Moved")) }
+func FuzzPlayerStatsSchemaDecode(f *testing.F)    { fuzzDecode(f, gameSchema("PlayerStats")) }
+func FuzzAdminStatsSchemaDecode(f *testing.F)     { fuzzDecode(f, gameSchema("AdminStats")) }
+func FuzzFoodCreatedSchemaDecode(f *testing.F)    { fuzzDecode(f, gameSchema("FoodCreated")) }
+func FuzzFoodEatenSchemaDecode(f *testing.F)      { fuzzDecode(f, gameSchema("FoodEaten")) }
+func FuzzPlayersUpdatedSchemaDecode(f *testing.F) { fuzzDecode(f, gameSchema("PlayersUpdated")) }
+func FuzzResumeSchemaDecode(f *testing.F)         { fuzzDecode(f, gameSchema("Resume")) }
+func FuzzAnnouncementSchemaDecode(f *testing.F)   { fuzzDecode(f, gameSchema("Announcement")) }
@@ -0,0 +1,365 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/diyor28/not-agar/src/csbin"
+	"github.com/diyor28/not-agar/src/gamengine/constants"
+	"github.com/diyor28/not-agar/src/gamengine/schemas"
+	"github.com/frankenbeanies/uuid4"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type schemaCase struct {
+	name     string
+	schema   *csbin.Schema
+	newValue func() interface{}
+}
+
+func newMap() interface{} {
+	m := make(map[string]interface{})
+	return &m
+}
+
+// gameSchemas lists the schemas of the game events, see gameSchema to pick
+// one by name.
+var gameSchemas = []schemaCase{
+	{"Generic", schemas.GenericSchema, func() interface{} { return &schemas.GenericEvent{} }},
+	{"PingPong", schemas.PingPongSchema, func() interface{} { return &schemas.PingPongEvent{} }},
+	{"Start", schemas.StartSchema, newMap},
+	{"Started", schemas.StartedSchema, func() interface{} { return &schemas.StartedEvent{} }},
+	{"Move", schemas.MoveSchema, func() interface{} { return &schemas.MoveEvent{} }},
+	{"Moved", schemas.MovedSchema, func() interface{} { return &schemas.MovedEvent{} }},
+	{"PlayerStats", schemas.PlayerStatsSchema, func() interface{} { return &schemas.PlayerStatsEvent{} }},
+	{"AdminStats", schemas.AdminStatsSchema, newMap},
+	{"FoodCreated", schemas.FoodCreatedSchema, func() interface{} { return &schemas.FoodCreatedEvent{} }},
+	{"FoodEaten", schemas.FoodEatenSchema, func() interface{} { return &schemas.FoodEatenEvent{} }},
+	{"PlayersUpdated", schemas.PlayersUpdatedSchema, func() interface{} { return &schemas.PlayersUpdatedEvent{} }},
+	{"Resume", schemas.ResumeSchema, func() interface{} { return &schemas.ResumeEvent{} }},
+	{"Announcement", schemas.AnnouncementSchema, func() interface{} { return &schemas.AnnouncementEvent{} }},
+}
+
+// fill populates v with random data small enough to satisfy the MaxLen
+// limits used by the game schemas.
+func fill(rnd *rand.Rand, v reflect.Value) {
+	switch v.Type() {
+	case reflect.TypeOf(time.Time{}):
+		v.Set(reflect.ValueOf(time.Unix(rnd.Int63n(1<<33), rnd.Int63n(1000)*int64(time.Millisecond)).UTC()))
+		return
+	case reflect.TypeOf(uuid4.UUID4{}):
+		v.Set(reflect.ValueOf(uuid4.New()))
+		return
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		fill(rnd, v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			fill(rnd, v.Field(i))
+		}
+	case reflect.Slice:
+		n := rnd.Intn(8)
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		for i := 0; i < n; i++ {
+			fill(rnd, v.Index(i))
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			fill(rnd, v.Index(i))
+		}
+	case reflect.String:
+		v.SetString(randomString(rnd, rnd.Intn(16)))
+	case reflect.Bool:
+		v.SetBool(rnd.Intn(2) == 1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(rnd.Uint64())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(rnd.Uint64()))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(float64(float32(rnd.NormFloat64() * 1000)))
+	}
+}
+
+func randomString(rnd *rand.Rand, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte('a' + rnd.Intn(26))
+	}
+	return string(b)
+}
+
+// fieldSpec mirrors a csbin.Field so that random schemas can be paired with
+// a matching Go type and random values.
+type fieldSpec struct {
+	name     string
+	kind     reflect.Kind
+	optional bool
+	len      uint64
+	maxLen   uint64
+	elem     *fieldSpec
+	fields   []*fieldSpec
+}
+
+var scalarKinds = []reflect.Kind{
+	reflect.Bool, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+	reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Float32, reflect.Float64,
+}
+
+var stringMaxLens = []uint64{1, 254, 255, 256, 1000, 65535, 65536}
+
+var sliceMaxLens = []uint64{1, 3, 255, 256}
+
+func randomSpec(rnd *rand.Rand, name string, depth int) *fieldSpec {
+	spec := &fieldSpec{name: name, optional: rnd.Intn(4) == 0}
+	choice := rnd.Intn(10)
+	if depth <= 0 && choice >= 6 {
+		choice = rnd.Intn(6)
+	}
+	switch {
+	case choice < 4:
+		spec.kind = scalarKinds[rnd.Intn(len(scalarKinds))]
+	case choice < 6:
+		spec.kind = reflect.String
+		switch rnd.Intn(3) {
+		case 0:
+			spec.len = uint64(1 + rnd.Intn(8))
+		case 1:
+			spec.maxLen = stringMaxLens[rnd.Intn(len(stringMaxLens))]
+		}
+	case choice < 8:
+		spec.kind = reflect.Slice
+		if rnd.Intn(2) == 0 {
+			spec.maxLen = sliceMaxLens[rnd.Intn(len(sliceMaxLens))]
+		}
+		spec.elem = randomSpec(rnd, name+"el", depth-1)
+		spec.elem.optional = false
+	case choice < 9:
+		spec.kind = reflect.Array
+		spec.len = uint64(1 + rnd.Intn(4))
+		spec.elem = randomSpec(rnd, name+"el", depth-1)
+		spec.elem.optional = false
+	default:
+		spec.kind = reflect.Struct
+		spec.fields = randomSpecs(rnd, name, depth-1)
+	}
+	return spec
+}
+
+func randomSpecs(rnd *rand.Rand, prefix string, depth int) []*fieldSpec {
+	n := 1 + rnd.Intn(5)
+	specs := make([]*fieldSpec, n)
+	for i := range specs {
+		specs[i] = randomSpec(rnd, fmt.Sprintf("%sf%d", prefix, i), depth)
+	}
+	return specs
+}
+
+func (s *fieldSpec) goType() reflect.Type {
+	switch s.kind {
+	case reflect.Slice:
+		return reflect.SliceOf(s.elem.goType())
+	case reflect.Array:
+		return reflect.ArrayOf(int(s.len), s.elem.goType())
+	case reflect.Struct:
+		return structOf(s.fields)
+	}
+	return csbin.NewField(s.name, s.kind).ConstructType()
+}
+
+func structOf(specs []*fieldSpec) reflect.Type {
+	fields := make([]reflect.StructField, len(specs))
+	for i, s := range specs {
+		fields[i] = reflect.StructField{Name: strings.Title(s.name), Type: s.goType()}
+	}
+	return reflect.StructOf(fields)
+}
+
+func (s *fieldSpec) field() *csbin.Field {
+	field := csbin.NewField(s.name, s.kind)
+	if s.optional {
+		field.Optional()
+	}
+	if s.len > 0 {
+		field.Len(s.len)
+	}
+	if s.maxLen > 0 {
+		field.MaxLen(s.maxLen)
+	}
+	switch s.kind {
+	case reflect.Slice, reflect.Array:
+		field.SubType(s.elem.field())
+	case reflect.Struct:
+		field.UseStruct(reflect.New(s.goType()).Interface()).SubFields(fields(s.fields)...)
+	}
+	return field
+}
+
+func fields(specs []*fieldSpec) []*csbin.Field {
+	result := make([]*csbin.Field, len(specs))
+	for i, s := range specs {
+		result[i] = s.field()
+	}
+	return result
+}
+
+// randomLen favours the boundaries of the allowed length range, limit is
+// used when maxLen is not set or exceeds it.
+func randomLen(rnd *rand.Rand, maxLen uint64, limit int) int {
+	if maxLen == 0 || maxLen > uint64(limit) {
+		maxLen = uint64(limit)
+	}
+	switch rnd.Intn(4) {
+	case 0:
+		return 0
+	case 1:
+		return int(maxLen)
+	case 2:
+		if maxLen > 0 {
+			return int(maxLen) - 1
+		}
+	}
+	return rnd.Intn(int(maxLen) + 1)
+}
+
+func (s *fieldSpec) random(rnd *rand.Rand, v reflect.Value, budget int) {
+	if s.optional && rnd.Intn(3) == 0 {
+		return
+	}
+	switch s.kind {
+	case reflect.String:
+		if s.len > 0 {
+			v.SetString(randomString(rnd, int(s.len)))
+		} else {
+			limit := math.MaxUint16
+			if s.maxLen > uint64(limit) {
+				limit = int(s.maxLen)
+			}
+			v.SetString(randomString(rnd, randomLen(rnd, s.maxLen, limit)))
+		}
+	case reflect.Slice:
+		n := randomLen(rnd, s.maxLen, budget)
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		for i := 0; i < n; i++ {
+			s.elem.random(rnd, v.Index(i), budget/(n+1))
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			s.elem.random(rnd, v.Index(i), budget)
+		}
+	case reflect.Struct:
+		for i, sub := range s.fields {
+			sub.random(rnd, v.Field(i), budget)
+		}
+	default:
+		fill(rnd, v)
+	}
+}
+
+func roundTrip(t *testing.T, schema *csbin.Schema, value interface{}, decoded interface{}) {
+	writer, err := schema.Encode(value)
+	if err != nil {
+		t.Fatalf("Encode(): %v", err)
+	}
+	if err := schema.Decode(writer.Bytes(), decoded); err != nil {
+		t.Fatalf("Decode(): %v", err)
+	}
+	if !reflect.DeepEqual(value, decoded) {
+		t.Fatalf("round trip mismatch:\nencoded: %#v\ndecoded: %#v", value, decoded)
+	}
+}
+
+func TestCodecRoundTripRandomSchemas(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 300; i++ {
+		specs := randomSpecs(rnd, "", 3)
+		schema := csbin.New(fields(specs)...)
+		value := reflect.New(structOf(specs))
+		for j, s := range specs {
+			s.random(rnd, value.Elem().Field(j), 300)
+		}
+		decoded := reflect.New(value.Elem().Type())
+		stale := reflect.New(value.Elem().Type())
+		for j, s := range specs {
+			s.random(rnd, stale.Elem().Field(j), 300)
+		}
+		t.Run(fmt.Sprintf("schema%d", i), func(t *testing.T) {
+			roundTrip(t, schema, value.Interface(), decoded.Interface())
+			writer, err := schema.Encode(value.Interface())
+			if err != nil {
+				t.Fatalf("Encode(): %v", err)
+			}
+			if err := schema.DecodeInto(writer.Bytes(), stale.Interface()); err != nil {
+				t.Fatalf("DecodeInto(): %v", err)
+			}
+			if !reflect.DeepEqual(value.Interface(), stale.Interface()) {
+				t.Fatalf("DecodeInto mismatch:\nencoded: %#v\ndecoded: %#v", value.Interface(), stale.Interface())
+			}
+		})
+	}
+}
+
+func TestCodecRoundTripGameSchemas(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, c := range gameSchemas {
+		value := c.newValue()
+		if reflect.ValueOf(value).Elem().Kind() == reflect.Map {
+			continue
+		}
+		t.Run(c.name, func(t *testing.T) {
+			for i := 0; i < 50; i++ {
+				value := c.newValue()
+				fill(rnd, reflect.ValueOf(value).Elem())
+				roundTrip(t, c.schema, value, c.newValue())
+			}
+		})
+	}
+}
+
+func TestCodecRoundTripMap(t *testing.T) {
+	value := map[string]interface{}{"event": uint8(constants.Start), "nickname": "demo", "room": "lobby"}
+	roundTrip(t, schemas.StartSchema, &value, newMap())
+}
+
+func TestCodecStringMaxLenBoundaries(t *testing.T) {
+	type Nickname struct {
+		Nickname string
+	}
+	for _, maxLen := range stringMaxLens {
+		schema := csbin.New(csbin.NewField("nickname", reflect.String).MaxLen(maxLen))
+		for _, n := range []uint64{0, maxLen - 1, maxLen} {
+			roundTrip(t, schema, &Nickname{strings.Repeat("x", int(n))}, &Nickname{})
+		}
+		if _, err := schema.Encode(&Nickname{strings.Repeat("x", int(maxLen)+1)}); err == nil {
+			t.Errorf("expected an error for a string of length %d with MaxLen(%d)", maxLen+1, maxLen)
+		}
+	}
+}
+
+func TestCodecZeroRequiredFieldWithOptional(t *testing.T) {
+	type Player struct {
+		X uint8
+		Y uint8
+		Z uint8
+	}
+	schema := csbin.New(
+		csbin.NewField("x", reflect.Uint8),
+		csbin.NewField("y", reflect.Uint8),
+		csbin.NewField("z", reflect.Uint8).Optional(),
+	)
+	roundTrip(t, schema, &Player{X: 0, Y: 12, Z: 3}, &Player{})
+}
+
+// gameSchema returns the case of gameSchemas called name.
+func gameSchema(name string) schemaCase {
+	for _, c := range gameSchemas {
+		if c.name == name {
+			return c
+		}
+	}
+	panic(fmt.Sprintf("no game schema called %q", name))
+}
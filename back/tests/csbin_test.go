@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"github.com/diyor28/not-agar/src/csbin"
 	"github.com/diyor28/not-agar/src/csbin/bitmask"
+	"github.com/frankenbeanies/uuid4"
 	"reflect"
 	"testing"
+	"time"
 )
 
 type MoveEvent struct {
@@ -283,3 +285,182 @@ func TestCodecArrayXYFloat32StringEncode(t *testing.T) {
 		t.Error(fmt.Sprintf("expected: 0241f0000042340000c1c80000c1f00000000464656d6f \ngot: %s", hexString))
 	}
 }
+
+func TestCodecTimeDurationUUID(t *testing.T) {
+	type Session struct {
+		Token   uuid4.UUID4
+		Started time.Time
+		Expires time.Time
+		Timeout time.Duration
+	}
+
+	codec := csbin.New(
+		csbin.NewUUIDField("token"),
+		csbin.NewTimeField("started", time.Millisecond),
+		csbin.NewTimeField("expires", time.Microsecond),
+		csbin.NewDurationField("timeout", time.Millisecond),
+	)
+	token, err := uuid4.ParseString("6625b113-61ff-49a2-bfe9-935ec1014f82")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	session := &Session{
+		Token:   token,
+		Started: time.Unix(1609459200, 123456789),
+		Expires: time.Unix(1609459200, 123456789),
+		Timeout: 1500 * time.Millisecond,
+	}
+	writer, err := codec.Encode(session)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	hexString := hex.EncodeToString(writer.Bytes())
+	expected := "6625b11361ff49a2bfe9935ec1014f82" + "00000176bb3e707b" + "0005b7cb6be76240" + "00000000000005dc"
+	if hexString != expected {
+		t.Error(fmt.Sprintf("expected: %s \ngot: %s", expected, hexString))
+	}
+	decoded := &Session{}
+	if err := codec.Decode(writer.Bytes(), decoded); err != nil {
+		t.Error(err)
+		return
+	}
+	if decoded.Token.String() != token.String() {
+		t.Error(fmt.Sprintf("expected: {\"token\": %s} got: {\"token\": %s}", token, decoded.Token))
+	}
+	if !decoded.Started.Equal(time.Unix(1609459200, 123000000)) {
+		t.Error(fmt.Sprintf("expected: {\"started\": 1609459200123ms} got: {\"started\": %s}", decoded.Started))
+	}
+	if !decoded.Expires.Equal(time.Unix(1609459200, 123456000)) {
+		t.Error(fmt.Sprintf("expected: {\"expires\": 1609459200123456µs} got: {\"expires\": %s}", decoded.Expires))
+	}
+	if decoded.Timeout != session.Timeout {
+		t.Error(fmt.Sprintf("expected: {\"timeout\": %s} got: {\"timeout\": %s}", session.Timeout, decoded.Timeout))
+	}
+}
+
+func TestCodecRejectsInvalidUUID(t *testing.T) {
+	type Session struct {
+		Token uuid4.UUID4
+	}
+	codec := csbin.New(csbin.NewUUIDField("token"))
+	for name, data := range map[string][]byte{
+		"zero":  make([]byte, 16),
+		"short": {0x66, 0x25, 0xb1, 0x13},
+	} {
+		if err := codec.Decode(data, &Session{}); err == nil {
+			t.Errorf("decoded a %s UUID", name)
+		}
+	}
+}
+
+func TestCodecDecodeIntoReuses(t *testing.T) {
+	type Point struct {
+		X float32
+		Y float32
+	}
+	type Moved struct {
+		Event  string
+		Nick   string
+		Points []*Point
+	}
+
+	codec := csbin.New(
+		csbin.NewField("event", reflect.String),
+		csbin.NewField("nick", reflect.String).Optional(),
+		csbin.NewField("points", reflect.Slice).MaxLen(255).SubType(
+			csbin.NewField("point", reflect.Struct).SubFields(
+				csbin.NewField("x", reflect.Float32),
+				csbin.NewField("y", reflect.Float32),
+			)),
+	)
+	writer, err := codec.Encode(&Moved{Event: "moved", Points: []*Point{{1, 2}, {3, 4}}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	first := &Point{}
+	decoded := &Moved{Nick: "stale", Points: make([]*Point, 1, 8)}
+	decoded.Points[0] = first
+	if err := codec.DecodeInto(writer.Bytes(), decoded); err != nil {
+		t.Error(err)
+		return
+	}
+	if decoded.Points[0] != first || *first != (Point{1, 2}) {
+		t.Error(fmt.Sprintf("expected points[0] to be reused and set to {1 2}, got: %v", *decoded.Points[0]))
+	}
+	if cap(decoded.Points) != 8 || len(decoded.Points) != 2 || *decoded.Points[1] != (Point{3, 4}) {
+		t.Error(fmt.Sprintf("expected points with len 2 and cap 8, got: len %d, cap %d", len(decoded.Points), cap(decoded.Points)))
+	}
+	if decoded.Nick != "" {
+		t.Error(fmt.Sprintf("expected missing optional nick to be reset, got: %s", decoded.Nick))
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = codec.DecodeInto(writer.Bytes(), decoded)
+	})
+	freshAllocs := testing.AllocsPerRun(100, func() {
+		_ = codec.Decode(writer.Bytes(), &Moved{})
+	})
+	if allocs >= freshAllocs {
+		t.Error(fmt.Sprintf("expected DecodeInto to allocate less than Decode, got %v >= %v", allocs, freshAllocs))
+	}
+}
+
+func TestCodecDecodeReplacesPointers(t *testing.T) {
+	type Player struct {
+		X uint8
+	}
+	type Started struct {
+		Player *Player
+		Stats  map[string]interface{}
+	}
+	codec := csbin.New(
+		csbin.NewField("player", reflect.Struct).SubFields(csbin.NewField("x", reflect.Uint8)),
+		csbin.NewField("stats", reflect.Struct).SubFields(csbin.NewField("count", reflect.Uint8)),
+	)
+	writer, err := codec.Encode(&Started{Player: &Player{X: 7}, Stats: map[string]interface{}{"count": uint8(3)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	player := &Player{X: 1}
+	stats := map[string]interface{}{}
+	decoded := &Started{Player: player, Stats: stats}
+	if err := codec.Decode(writer.Bytes(), decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Player == player || player.X != 1 || decoded.Player.X != 7 {
+		t.Error(fmt.Sprintf("expected Decode to leave the caller's player alone, got: %v %v", *player, *decoded.Player))
+	}
+	if len(stats) != 0 || decoded.Stats["count"] != uint8(3) {
+		t.Error(fmt.Sprintf("expected Decode to leave the caller's map alone, got: %v %v", stats, decoded.Stats))
+	}
+}
+
+func TestCodecDecodeIntoClearsMapOptionals(t *testing.T) {
+	codec := csbin.New(
+		csbin.NewField("event", reflect.Uint8),
+		csbin.NewField("nick", reflect.String).Optional(),
+	)
+	withNick, err := codec.Encode(&map[string]interface{}{"event": uint8(1), "nick": "tester"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutNick, err := codec.Encode(&map[string]interface{}{"event": uint8(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := map[string]interface{}{}
+	if err := codec.DecodeInto(withNick.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["nick"] != "tester" {
+		t.Fatal(fmt.Sprintf("expected nick tester, got: %v", decoded))
+	}
+	if err := codec.DecodeInto(withoutNick.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoded["nick"]; ok || decoded["event"] != uint8(2) {
+		t.Error(fmt.Sprintf("expected missing optional nick to be removed, got: %v", decoded))
+	}
+}
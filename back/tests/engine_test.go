@@ -0,0 +1,264 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"github.com/diyor28/not-agar/src/csbin"
+	"github.com/diyor28/not-agar/src/gamengine"
+	"github.com/diyor28/not-agar/src/gamengine/constants"
+	"github.com/diyor28/not-agar/src/gamengine/schemas"
+	"github.com/diyor28/not-agar/src/sockethub"
+	"github.com/frankenbeanies/uuid4"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// startEngine runs a GameEngine whose hub serves in-memory connections,
+// configure is called before the engine starts.
+func startEngine(t *testing.T, configure func(eng *gamengine.GameEngine)) *sockethub.MemoryTransport {
+	eng := gamengine.NewGameMap(50)
+	if configure != nil {
+		configure(eng)
+	}
+	transport := sockethub.NewMemoryTransport()
+	go eng.Run()
+	go eng.Hub.Serve(transport)
+	shutdownHub(t, eng.Hub)
+	t.Cleanup(eng.Stop)
+	return transport
+}
+
+func send(t *testing.T, conn sockethub.Conn, schema *csbin.Schema, event interface{}) {
+	writer, err := schema.Encode(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(writer.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectEvent reads from conn, unwrapping batches, until an event of kind
+// want arrives and decodes it into result.
+func expectEvent(t *testing.T, conn sockethub.Conn, want constants.GameEvent, schema *csbin.Schema, result interface{}) {
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for event %d: %v", want, err)
+		}
+		messages := [][]byte{data}
+		if constants.GameEvent(data[0]) == constants.Batch {
+			if messages, err = schemas.DecodeBatch(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, message := range messages {
+			if constants.GameEvent(message[0]) != want {
+				continue
+			}
+			if err := schema.Decode(message, result); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+}
+
+func TestEngineInProcess(t *testing.T) {
+	var hub *sockethub.Hub
+	transport := startEngine(t, func(eng *gamengine.GameEngine) {
+		hub = eng.Hub
+	})
+	conn, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	send(t, conn, schemas.StartSchema, &startEvent{Event: constants.Start, Nickname: "tester"})
+	started := &schemas.StartedEvent{}
+	expectEvent(t, conn, constants.Started, schemas.StartedSchema, started)
+	if started.Player == nil || started.Player.Weight <= 0 {
+		t.Fatalf("unexpected player in Started %+v", started.Player)
+	}
+	// broadcasts go to the clients in the room of the players
+	if counts := hub.RoomCounts(); !reflect.DeepEqual(counts, map[string]int{"players": 1}) {
+		t.Fatalf("unexpected rooms %v", counts)
+	}
+
+	send(t, conn, schemas.MoveSchema, &schemas.MoveEvent{Event: constants.Move, NewX: started.Player.X + 100, NewY: started.Player.Y})
+	moved := &schemas.MovedEvent{}
+	expectEvent(t, conn, constants.Moved, schemas.MovedSchema, moved)
+	if moved.Weight <= 0 || len(moved.Points) == 0 {
+		t.Fatalf("unexpected Moved event %+v", moved)
+	}
+
+	timestamp := time.Unix(1609459200, 0).UTC()
+	send(t, conn, schemas.PingPongSchema, &schemas.PingPongEvent{Event: constants.Ping, Timestamp: timestamp})
+	pong := &schemas.PingPongEvent{}
+	expectEvent(t, conn, constants.Pong, schemas.PingPongSchema, pong)
+	if !pong.Timestamp.Equal(timestamp) {
+		t.Fatalf("expected pong timestamp %v, got %v", timestamp, pong.Timestamp)
+	}
+}
+
+func TestPipeConn(t *testing.T) {
+	server, client := sockethub.Pipe()
+	pongs := make(chan struct{}, 1)
+	server.SetPongHandler(func() {
+		pongs <- struct{}{}
+	})
+	go func() {
+		// the client's reader answers pings while waiting for data
+		data, err := client.ReadMessage()
+		if err == nil {
+			err = client.WriteMessage(data)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+		client.Close()
+	}()
+	if err := server.WritePing(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.WriteMessage([]byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := server.ReadMessage()
+	if err != nil || len(data) != 2 {
+		t.Fatalf("unexpected echo %v, %v", data, err)
+	}
+	select {
+	case <-pongs:
+	default:
+		t.Fatal("ping was not answered")
+	}
+	if _, err := server.ReadMessage(); err != io.EOF {
+		t.Fatalf("expected io.EOF after the peer closed, got %v", err)
+	}
+
+	server, _ = sockethub.Pipe()
+	if err := server.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.ReadMessage()
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
+
+func dialEngine(t *testing.T, transport *sockethub.MemoryTransport) sockethub.Conn {
+	conn, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+func TestEngineResume(t *testing.T) {
+	transport := startEngine(t, nil)
+	conn := dialEngine(t, transport)
+	send(t, conn, schemas.StartSchema, &startEvent{Event: constants.Start, Nickname: "tester"})
+	started := &schemas.StartedEvent{}
+	expectEvent(t, conn, constants.Started, schemas.StartedSchema, started)
+	if bytes.Equal(started.Session.Bytes(), make([]byte, 16)) {
+		t.Fatalf("Started carries no session: %v", started.Session)
+	}
+	conn.Close()
+
+	conn = dialEngine(t, transport)
+	send(t, conn, schemas.ResumeSchema, &schemas.ResumeEvent{Event: constants.Resume, Session: started.Session})
+	resumed := &schemas.StartedEvent{}
+	expectEvent(t, conn, constants.Started, schemas.StartedSchema, resumed)
+	if resumed.Session.String() != started.Session.String() {
+		t.Fatalf("resumed session %v, expected %v", resumed.Session, started.Session)
+	}
+	if resumed.Player.Color != started.Player.Color {
+		t.Fatal("resumed a different player")
+	}
+
+	conn = dialEngine(t, transport)
+	send(t, conn, schemas.ResumeSchema, &schemas.ResumeEvent{Event: constants.Resume, Session: uuid4.New()})
+	expectEvent(t, conn, constants.ResumeFailed, schemas.GenericSchema, &schemas.GenericEvent{})
+}
+
+func TestEngineResumeZeroSession(t *testing.T) {
+	transport := startEngine(t, nil)
+	conn := dialEngine(t, transport)
+	send(t, conn, schemas.ResumeSchema, &schemas.ResumeEvent{Event: constants.Resume})
+	expectEvent(t, conn, constants.ResumeFailed, schemas.GenericSchema, &schemas.GenericEvent{})
+	send(t, conn, schemas.StartSchema, &startEvent{Event: constants.Start, Nickname: "tester"})
+	expectEvent(t, conn, constants.Started, schemas.StartedSchema, &schemas.StartedEvent{})
+}
+
+func TestEngineResumeAfterGrace(t *testing.T) {
+	transport := startEngine(t, func(eng *gamengine.GameEngine) {
+		eng.SessionGrace = 50 * time.Millisecond
+		eng.FreezeDetached = true
+	})
+	conn := dialEngine(t, transport)
+	send(t, conn, schemas.StartSchema, &startEvent{Event: constants.Start, Nickname: "tester"})
+	started := &schemas.StartedEvent{}
+	expectEvent(t, conn, constants.Started, schemas.StartedSchema, started)
+	conn.Close()
+	time.Sleep(300 * time.Millisecond)
+
+	conn = dialEngine(t, transport)
+	send(t, conn, schemas.ResumeSchema, &schemas.ResumeEvent{Event: constants.Resume, Session: started.Session})
+	expectEvent(t, conn, constants.ResumeFailed, schemas.GenericSchema, &schemas.GenericEvent{})
+}
+
+func TestEngineStopDisconnect(t *testing.T) {
+	const clients = 100
+	eng := gamengine.NewGameMap(50)
+	transport := sockethub.NewMemoryTransport()
+	go eng.Run()
+	go eng.Hub.Serve(transport)
+	for i := 0; i < clients; i++ {
+		conn, err := transport.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	eng.Stop()
+	// more disconnects than the engine buffers must not block the hub
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := eng.Hub.Shutdown(ctx); err != nil {
+		t.Fatalf("hub did not shut down after the engine stopped: %v", err)
+	}
+}
+
+func TestEngineNothingFollowsRip(t *testing.T) {
+	// ticking once a second leaves the time to start before the first tick,
+	// in which the giants tiling the map eat the player
+	eng := gamengine.NewGameMap(1)
+	for x := 200; x < constants.MaxXY; x += 400 {
+		for y := 200; y < constants.MaxXY; y += 400 {
+			eng.Map.Players.New(float32(x), float32(y), constants.MaxWeight, "giant", false)
+		}
+	}
+	transport := sockethub.NewMemoryTransport()
+	go eng.Run()
+	go eng.Hub.Serve(transport)
+	shutdownHub(t, eng.Hub)
+	t.Cleanup(eng.Stop)
+	conn := dialEngine(t, transport)
+	send(t, conn, schemas.StartSchema, &startEvent{Event: constants.Start, Nickname: "tester"})
+	expectEvent(t, conn, constants.Started, schemas.StartedSchema, &schemas.StartedEvent{})
+	expectEvent(t, conn, constants.Rip, schemas.GenericSchema, &schemas.GenericEvent{})
+	if frames := readFrames(t, conn); len(frames) != 0 {
+		t.Fatalf("received %d frames after Rip", len(frames))
+	}
+}
@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"github.com/diyor28/not-agar/src/sockethub"
+	"github.com/gorilla/websocket"
+	"testing"
+	"time"
+)
+
+// dialHeartbeat connects to url and reads until the connection is dropped,
+// answering pings only when pong is set. The returned channel receives the
+// time the connection was lost.
+func dialHeartbeat(t *testing.T, url string, pong bool) <-chan time.Time {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	if !pong {
+		conn.SetPingHandler(func(string) error { return nil })
+	}
+	dropped := make(chan time.Time, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				dropped <- time.Now()
+				return
+			}
+		}
+	}()
+	return dropped
+}
+
+func TestHubPongWait(t *testing.T) {
+	config := sockethub.DefaultConfig()
+	config.PingInterval = 20 * time.Millisecond
+	config.PongWait = 200 * time.Millisecond
+	config.IdleTimeout = 0
+	hub := sockethub.NewHubWithConfig(config)
+	url := serveWebsocket(t, hub, sockethub.NewWebsocketTransport(websocket.Upgrader{}))
+
+	started := time.Now()
+	silent := dialHeartbeat(t, url, false)
+	answering := dialHeartbeat(t, url, true)
+	select {
+	case dropped := <-silent:
+		if elapsed := dropped.Sub(started); elapsed < config.PongWait {
+			t.Fatalf("dropped after %v, before PongWait", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not answering pings was kept")
+	}
+	select {
+	case <-answering:
+		t.Fatal("peer answering pings was dropped")
+	case <-time.After(3 * config.PongWait):
+	}
+}
@@ -0,0 +1,205 @@
+package tests
+
+import (
+	"encoding/binary"
+	"github.com/diyor28/not-agar/src/sockethub"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHubInboundOrder(t *testing.T) {
+	const clients, messages = 6, 300
+	config := sockethub.DefaultConfig()
+	config.Workers = 3
+	config.InboundQueueSize = 8
+	hub := sockethub.NewHubWithConfig(config)
+
+	var mu sync.Mutex
+	next := make(map[*sockethub.Client]uint32)
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	wg.Add(clients * messages)
+	hub.OnMessage(func(data []byte, client *sockethub.Client) {
+		defer wg.Done()
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		mu.Lock()
+		if n > maxRunning {
+			maxRunning = n
+		}
+		seq := binary.BigEndian.Uint32(data)
+		if seq != next[client] {
+			t.Errorf("expected message %d, got %d", next[client], seq)
+		}
+		next[client] = seq + 1
+		mu.Unlock()
+		time.Sleep(10 * time.Microsecond)
+	})
+	transport := sockethub.NewMemoryTransport()
+	serveHub(t, hub, transport)
+
+	for i := 0; i < clients; i++ {
+		conn, err := transport.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		go func() {
+			for n := 0; n < messages; n++ {
+				data := make([]byte, 4)
+				binary.BigEndian.PutUint32(data, uint32(n))
+				if err := conn.WriteMessage(data); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("not every message was handled")
+	}
+	if maxRunning > int32(config.Workers) {
+		t.Fatalf("%d messages were handled at once with %d workers", maxRunning, config.Workers)
+	}
+}
+
+func TestHubInboundDisconnect(t *testing.T) {
+	config := sockethub.DefaultConfig()
+	config.InboundQueueSize = 2
+	config.InboundPolicy = sockethub.InboundDisconnect
+	hub := sockethub.NewHubWithConfig(config)
+	var disconnected, handledAfterDisconnect int32
+	hub.OnMessage(func(data []byte, client *sockethub.Client) {
+		time.Sleep(20 * time.Millisecond)
+		if atomic.LoadInt32(&disconnected) == 1 {
+			atomic.AddInt32(&handledAfterDisconnect, 1)
+		}
+	})
+	reasons := make(chan sockethub.DisconnectReason, 1)
+	hub.OnDisconnect(func(client *sockethub.Client, reason sockethub.DisconnectReason) {
+		atomic.StoreInt32(&disconnected, 1)
+		reasons <- reason
+	})
+	transport := sockethub.NewMemoryTransport()
+	serveHub(t, hub, transport)
+	conn, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		if err := conn.WriteMessage([]byte{byte(i)}); err != nil {
+			break
+		}
+	}
+	select {
+	case reason := <-reasons:
+		if reason != sockethub.ReasonOverload {
+			t.Fatalf("expected reason %v, got %v", sockethub.ReasonOverload, reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("flooding client was not disconnected")
+	}
+	// OnDisconnect waits for the handler that was running
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&handledAfterDisconnect); n != 0 {
+		t.Fatalf("%d messages were handled after OnDisconnect", n)
+	}
+}
+
+func TestHubInboundZeroSize(t *testing.T) {
+	config := sockethub.DefaultConfig()
+	config.InboundQueueSize = 0
+	config.InboundPolicy = sockethub.InboundBlock
+	hub := sockethub.NewHubWithConfig(config)
+	handled := make(chan byte, 3)
+	hub.OnMessage(func(data []byte, client *sockethub.Client) {
+		handled <- data[0]
+	})
+	transport := sockethub.NewMemoryTransport()
+	serveHub(t, hub, transport)
+	conn, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		if err := conn.WriteMessage([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case n := <-handled:
+			if n != byte(i) {
+				t.Fatalf("expected message %d, got %d", i, n)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("message was not handled")
+		}
+	}
+}
+
+func TestHubInboundBlockKeepsAlive(t *testing.T) {
+	config := sockethub.DefaultConfig()
+	config.InboundQueueSize = 1
+	config.InboundPolicy = sockethub.InboundBlock
+	config.PingInterval = 20 * time.Millisecond
+	config.PongWait = 100 * time.Millisecond
+	config.IdleTimeout = 0
+	hub := sockethub.NewHubWithConfig(config)
+	release := make(chan struct{})
+	var handled int32
+	hub.OnMessage(func(data []byte, client *sockethub.Client) {
+		<-release
+		atomic.AddInt32(&handled, 1)
+	})
+	reasons := make(chan sockethub.DisconnectReason, 1)
+	hub.OnDisconnect(func(client *sockethub.Client, reason sockethub.DisconnectReason) {
+		reasons <- reason
+	})
+	transport := sockethub.NewMemoryTransport()
+	serveHub(t, hub, transport)
+	conn, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// reading answers the hub's pings
+	go func() {
+		for {
+			if _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		if err := conn.WriteMessage([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the reader stays blocked in dispatch for several PongWait
+	time.Sleep(4 * config.PongWait)
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&handled) < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages handled, expected 4", atomic.LoadInt32(&handled))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case reason := <-reasons:
+		t.Fatalf("client blocked by backpressure was disconnected: %v", reason)
+	case <-time.After(3 * config.PongWait):
+	}
+}
@@ -0,0 +1,148 @@
+package tests
+
+import (
+	"github.com/diyor28/not-agar/src/gamengine"
+	"github.com/diyor28/not-agar/src/gamengine/constants"
+	"github.com/diyor28/not-agar/src/gamengine/map/entity"
+	"github.com/diyor28/not-agar/src/gamengine/schemas"
+	"github.com/diyor28/not-agar/src/sockethub"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readFrames reads from conn until nothing more arrives for a while.
+func readFrames(t *testing.T, conn sockethub.Conn) [][]byte {
+	var frames [][]byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		data, err := conn.ReadMessage()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return frames
+			}
+			t.Fatal(err)
+		}
+		frames = append(frames, data)
+	}
+}
+
+func TestOutboxFramesPerTick(t *testing.T) {
+	const players = 3
+	hub := sockethub.NewHub()
+	connected := make(chan *sockethub.Client, players)
+	hub.OnConnect(func(client *sockethub.Client) {
+		connected <- client
+	})
+	transport := sockethub.NewMemoryTransport()
+	serveHub(t, hub, transport)
+	var clients []*sockethub.Client
+	var conns []sockethub.Conn
+	for i := 0; i < players; i++ {
+		conns = append(conns, dialEngine(t, transport))
+		clients = append(clients, <-connected)
+	}
+
+	outbox := gamengine.NewOutbox()
+	for _, client := range clients {
+		for _, event := range []constants.GameEvent{constants.Moved, constants.PlayersUpdate} {
+			outbox.Push(client, []byte{byte(event)})
+		}
+	}
+	// several foods eaten and created during the tick, the broadcasts list
+	// the clients in different orders
+	eaten, err := schemas.FoodEatenSchema.Encode(&schemas.FoodEatenEvent{
+		Event: constants.FoodEaten,
+		Ids:   []entity.Id{1, 2, 3, 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reversed := []*sockethub.Client{clients[2], clients[1], clients[0]}
+	outbox.Broadcast(clients, []byte{byte(constants.FoodCreated)})
+	outbox.Broadcast(reversed, eaten.Bytes())
+	outbox.Broadcast(clients, []byte{byte(constants.StatsUpdate)})
+	if failed := outbox.Flush(); len(failed) != 0 {
+		t.Fatal(failed)
+	}
+
+	for i, conn := range conns {
+		frames := readFrames(t, conn)
+		if len(frames) != 2 {
+			t.Fatalf("client %d received %d frames during the tick, expected 2", i, len(frames))
+		}
+		var events []constants.GameEvent
+		for _, frame := range frames {
+			if constants.GameEvent(frame[0]) != constants.Batch {
+				t.Fatalf("client %d received event %d outside of a batch", i, frame[0])
+			}
+			messages, err := schemas.DecodeBatch(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, message := range messages {
+				events = append(events, constants.GameEvent(message[0]))
+			}
+			if events[len(events)-1] == constants.StatsUpdate {
+				decoded := &schemas.FoodEatenEvent{}
+				if err := schemas.FoodEatenSchema.Decode(messages[1], decoded); err != nil {
+					t.Fatal(err)
+				}
+				if len(decoded.Ids) != 4 {
+					t.Fatalf("FoodEaten carries %v, expected 4 ids", decoded.Ids)
+				}
+			}
+		}
+		want := []constants.GameEvent{constants.Moved, constants.PlayersUpdate, constants.FoodCreated, constants.FoodEaten, constants.StatsUpdate}
+		if len(events) != len(want) {
+			t.Fatalf("client %d received %v, expected %v", i, events, want)
+		}
+		for j := range want {
+			if events[j] != want[j] {
+				t.Fatalf("client %d received %v, expected %v", i, events, want)
+			}
+		}
+	}
+}
+
+func TestOutboxTrafficPerEvent(t *testing.T) {
+	hub := sockethub.NewHub()
+	connected := make(chan *sockethub.Client, 2)
+	hub.OnConnect(func(client *sockethub.Client) {
+		connected <- client
+	})
+	transport := sockethub.NewMemoryTransport()
+	serveHub(t, hub, transport)
+	conns := []sockethub.Conn{dialEngine(t, transport), dialEngine(t, transport)}
+	clients := []*sockethub.Client{<-connected, <-connected}
+
+	outbox := gamengine.NewOutbox()
+	for _, client := range clients {
+		outbox.Push(client, []byte{byte(constants.Moved), 1, 2})
+		outbox.Push(client, []byte{byte(constants.PlayersUpdate)})
+	}
+	outbox.Broadcast(clients, []byte{byte(constants.FoodCreated), 1})
+	outbox.Broadcast(clients, []byte{byte(constants.StatsUpdate)})
+	if failed := outbox.Flush(); len(failed) != 0 {
+		t.Fatal(failed)
+	}
+	for _, conn := range conns {
+		readFrames(t, conn)
+	}
+
+	want := map[byte]sockethub.EventTraffic{
+		byte(constants.Moved):         {MessagesOut: 2, BytesOut: 6},
+		byte(constants.PlayersUpdate): {MessagesOut: 2, BytesOut: 2},
+		byte(constants.FoodCreated):   {MessagesOut: 2, BytesOut: 4},
+		byte(constants.StatsUpdate):   {MessagesOut: 2, BytesOut: 2},
+	}
+	// the writers count a message once its write has returned
+	var events map[byte]sockethub.EventTraffic
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if events = hub.Stats().Events; reflect.DeepEqual(events, want) {
+			return
+		}
+	}
+	t.Fatalf("batched events counted as %v, expected %v", events, want)
+}
@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"github.com/diyor28/not-agar/src/sockethub"
+	"testing"
+	"time"
+)
+
+const blocker = 0xff
+
+// queueHub connects a client to a hub configured with configure and returns
+// both ends, nothing is read from conn until the test does.
+func queueHub(t *testing.T, configure func(config *sockethub.Config)) (*sockethub.Client, sockethub.Conn, <-chan sockethub.DisconnectReason) {
+	config := sockethub.DefaultConfig()
+	configure(&config)
+	hub := sockethub.NewHubWithConfig(config)
+	connected := make(chan *sockethub.Client, 1)
+	disconnected := make(chan sockethub.DisconnectReason, 1)
+	hub.OnConnect(func(client *sockethub.Client) {
+		connected <- client
+	})
+	hub.OnDisconnect(func(client *sockethub.Client, reason sockethub.DisconnectReason) {
+		disconnected <- reason
+	})
+	transport := sockethub.NewMemoryTransport()
+	serveHub(t, hub, transport)
+	conn, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return <-connected, conn, disconnected
+}
+
+// stallWriter fills the in-memory pipe, which buffers 64 frames, so that the
+// client's writer blocks and whatever is emitted next stays in its queue.
+func stallWriter(t *testing.T, client *sockethub.Client) {
+	for i := 0; i < 65; i++ {
+		if err := client.Emit([]byte{blocker}); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for client.QueueStats().Queued > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("writer did not take the blocker")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// expectMessages skips the blockers and reads the events of the messages
+// that follow them.
+func expectMessages(t *testing.T, conn sockethub.Conn, want ...byte) {
+	var got []byte
+	for len(got) < len(want) {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read %v, expected %v: %v", got, want, err)
+		}
+		if data[0] != blocker {
+			got = append(got, data[0])
+		}
+	}
+	if string(got) != string(want) {
+		t.Fatalf("read %v, expected %v", got, want)
+	}
+}
+
+func TestSendQueueDropOldest(t *testing.T) {
+	const urgent = 100
+	client, conn, _ := queueHub(t, func(config *sockethub.Config) {
+		config.SendQueueSize = 4
+		config.SendQueuePolicy = sockethub.DropOldest
+		config.Priorities = map[byte]sockethub.Priority{
+			urgent:     sockethub.PriorityHigh,
+			urgent + 1: sockethub.PriorityHigh,
+		}
+	})
+	stallWriter(t, client)
+	for _, event := range []byte{1, 2, 3, 4, 5, 6, urgent, urgent + 1} {
+		if err := client.Emit([]byte{event}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the lanes share the bound, normal messages are dropped first
+	if stats := client.QueueStats(); stats.Queued != 4 || stats.Dropped != 4 {
+		t.Fatalf("unexpected queue stats %+v", stats)
+	}
+	expectMessages(t, conn, urgent, urgent+1, 5, 6)
+}
+
+func TestSendQueueCoalesce(t *testing.T) {
+	client, conn, _ := queueHub(t, func(config *sockethub.Config) {
+		config.SendQueueSize = 2
+		config.SendQueuePolicy = sockethub.Coalesce
+	})
+	stallWriter(t, client)
+	for _, event := range []byte{1, 2, 3} {
+		if err := client.EmitKeyed("position", []byte{event}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, event := range []byte{4, 5} {
+		if err := client.Emit([]byte{event}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := client.QueueStats(); stats.Queued != 2 || stats.Coalesced != 2 || stats.Dropped != 1 {
+		t.Fatalf("unexpected queue stats %+v", stats)
+	}
+	expectMessages(t, conn, 4, 5)
+}
+
+func TestSendQueueDisconnect(t *testing.T) {
+	client, _, disconnected := queueHub(t, func(config *sockethub.Config) {
+		config.SendQueueSize = 2
+		config.SendQueuePolicy = sockethub.Disconnect
+	})
+	stallWriter(t, client)
+	for _, event := range []byte{1, 2} {
+		if err := client.Emit([]byte{event}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Emit([]byte{3}); err != sockethub.ErrSlowConsumer {
+		t.Fatalf("expected ErrSlowConsumer, got %v", err)
+	}
+	select {
+	case reason := <-disconnected:
+		if reason != sockethub.ReasonSlowConsumer {
+			t.Fatalf("disconnected for %v", reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("slow client was not disconnected")
+	}
+}
+
+func TestSendQueueZeroSize(t *testing.T) {
+	for _, policy := range []sockethub.OverflowPolicy{sockethub.DropOldest, sockethub.Coalesce, sockethub.Disconnect} {
+		client, conn, _ := queueHub(t, func(config *sockethub.Config) {
+			config.SendQueueSize = 0
+			config.SendQueuePolicy = policy
+		})
+		if err := client.EmitKeyed("position", []byte{1}); err != nil {
+			t.Fatal(err)
+		}
+		expectMessages(t, conn, 1)
+	}
+}
@@ -0,0 +1,171 @@
+package tests
+
+import (
+	"bytes"
+	"github.com/diyor28/not-agar/src/sockethub"
+	"github.com/gorilla/websocket"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer collects what is logged during a test, from any goroutine.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestHubRateLimits(t *testing.T) {
+	logs := &logBuffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+	config := sockethub.DefaultConfig()
+	config.RateLimits = map[byte]sockethub.RateLimit{
+		1: {Rate: 0.001, Burst: 3, Action: sockethub.RateLimitDrop},
+		2: {Rate: 0.001, Burst: 1, Action: sockethub.RateLimitWarn},
+	}
+	config.DefaultRateLimit = &sockethub.RateLimit{Rate: 0.001, Burst: 2, Action: sockethub.RateLimitBan}
+	config.BanDuration = time.Minute
+	hub := sockethub.NewHubWithConfig(config)
+	var mu sync.Mutex
+	handled := make(map[byte]int)
+	hub.OnMessage(func(data []byte, client *sockethub.Client) {
+		mu.Lock()
+		handled[data[0]]++
+		mu.Unlock()
+	})
+	reasons := make(chan sockethub.DisconnectReason, 1)
+	hub.OnDisconnect(func(client *sockethub.Client, reason sockethub.DisconnectReason) {
+		reasons <- reason
+	})
+	transport := sockethub.NewMemoryTransport()
+	serveHub(t, hub, transport)
+	conn, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	send := func(events ...byte) {
+		for _, event := range events {
+			if err := conn.WriteMessage([]byte{event}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	count := func() map[byte]int {
+		mu.Lock()
+		defer mu.Unlock()
+		res := make(map[byte]int, len(handled))
+		for event, n := range handled {
+			res[event] = n
+		}
+		return res
+	}
+	// messages are handled asynchronously, wait until the last one went
+	// through
+	send(1, 1, 1, 1, 1, 2, 2, 2, 3)
+	deadline := time.Now().Add(2 * time.Second)
+	for count()[3] == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := count(); !reflect.DeepEqual(got, map[byte]int{1: 3, 2: 3, 3: 1}) {
+		t.Fatalf("unexpected handled counts %v", got)
+	}
+	// both drops happen within dropLogInterval
+	if n := strings.Count(logs.String(), "dropping event 1 from pipe-client"); n != 1 {
+		t.Fatalf("dropped messages were logged %d times, expected once", n)
+	}
+
+	send(3, 3)
+	select {
+	case reason := <-reasons:
+		if reason != sockethub.ReasonRateLimited {
+			t.Fatalf("expected reason %v, got %v", sockethub.ReasonRateLimited, reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("client was not disconnected")
+	}
+	if !hub.IsBanned("pipe-client") {
+		t.Fatal("client was not banned")
+	}
+	conn, err = transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ReadMessage(); err != io.EOF {
+		t.Fatalf("expected a banned client to be closed, got %v", err)
+	}
+}
+
+// floodThroughProxy connects to a hub trusting proxies as if through a proxy
+// forwarding for the client at 203.0.113.7 and floods an unknown event until
+// it is disconnected.
+func floodThroughProxy(t *testing.T, proxies []string) *sockethub.Hub {
+	config := sockethub.DefaultConfig()
+	config.DefaultRateLimit = &sockethub.RateLimit{Rate: 0.001, Burst: 1, Action: sockethub.RateLimitBan}
+	config.BanDuration = time.Minute
+	config.TrustedProxies = proxies
+	hub := sockethub.NewHubWithConfig(config)
+	url := serveWebsocket(t, hub, sockethub.NewWebsocketTransport(websocket.Upgrader{}))
+	header := http.Header{}
+	header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7")
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 2; i++ {
+		if err := conn.WriteMessage(websocket.BinaryMessage, []byte{1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatal("flooding client was not disconnected")
+			}
+			return hub
+		}
+	}
+}
+
+func TestHubBanTrustedProxies(t *testing.T) {
+	hub := floodThroughProxy(t, []string{"127.0.0.1"})
+	if !hub.IsBanned("203.0.113.7") {
+		t.Fatal("client behind the proxy was not banned")
+	}
+	if hub.IsBanned("127.0.0.1") || hub.IsBanned("198.51.100.1") {
+		t.Fatal("banned an address other than the client's")
+	}
+
+	// without trusted proxies the header can be forged by anyone
+	hub = floodThroughProxy(t, nil)
+	if hub.IsBanned("203.0.113.7") || !hub.IsBanned("127.0.0.1") {
+		t.Fatal("X-Forwarded-For was trusted")
+	}
+}
@@ -0,0 +1,284 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/diyor28/not-agar/src/csbin"
+	"github.com/diyor28/not-agar/src/gamengine/constants"
+	_map "github.com/diyor28/not-agar/src/gamengine/map"
+	"github.com/diyor28/not-agar/src/gamengine/map/entity"
+	"github.com/diyor28/not-agar/src/gamengine/map/players"
+	"github.com/diyor28/not-agar/src/gamengine/schemas"
+	"github.com/diyor28/not-agar/src/utils"
+	"testing"
+	"time"
+)
+
+// Benchmark payloads mirror a busy map: MaxBots bots with 50 point shells
+// and a full StartedSchema food list.
+const benchFoodCount = 10000
+
+type startEvent struct {
+	Event    constants.GameEvent
+	Nickname string
+	Room     string
+}
+
+type adminStatsEvent struct {
+	Event        constants.GameEvent
+	BotsCount    uint16
+	PlayersCount uint16
+	TopsPlayers  []*schemas.Player
+}
+
+type benchMessage struct {
+	name     string
+	schema   *csbin.Schema
+	value    interface{}
+	newValue func() interface{}
+	reused   interface{}
+}
+
+func benchPoints(pl *players.Player) []*schemas.Point {
+	res := make([]*schemas.Point, len(pl.Shell.Points))
+	for i, p := range pl.Shell.Points {
+		res[i] = &schemas.Point{X: int16(p.X * 100), Y: int16(p.Y * 100)}
+	}
+	return res
+}
+
+func benchPlayers(pls []*players.Player) []*schemas.Player {
+	res := make([]*schemas.Player, len(pls))
+	for i, p := range pls {
+		res[i] = &schemas.Player{X: uint16(p.X), Y: uint16(p.Y), Weight: p.Weight, Nickname: p.Nickname, Color: p.Color}
+	}
+	return res
+}
+
+func benchFood(n int) []*schemas.Food {
+	res := make([]*schemas.Food, n)
+	for i := range res {
+		x, y := utils.RandXY()
+		res[i] = &schemas.Food{Id: entity.Id(i + 1), X: x, Y: y, Weight: constants.FoodWeight, Color: utils.RandomColor()}
+	}
+	return res
+}
+
+func benchMessages() []benchMessage {
+	m := _map.New()
+	m.PopulateBots()
+	m.PopulateSpikes()
+	pl := m.Players.Players[0]
+	spikes := make([]*schemas.Spike, len(m.Spikes.Spikes))
+	for i, s := range m.Spikes.Spikes {
+		spikes[i] = &schemas.Spike{X: s.X, Y: s.Y, Weight: s.Weight}
+	}
+	messages := []benchMessage{
+		{
+			name:     "Ping",
+			schema:   schemas.PingPongSchema,
+			value:    &schemas.PingPongEvent{Event: constants.Ping, Timestamp: time.Unix(1609459200, 0)},
+			newValue: func() interface{} { return &schemas.PingPongEvent{} },
+		},
+		{
+			name:     "Start",
+			schema:   schemas.StartSchema,
+			value:    &startEvent{Event: constants.Start, Nickname: pl.Nickname},
+			newValue: func() interface{} { return &startEvent{} },
+		},
+		{
+			name:   "Started",
+			schema: schemas.StartedSchema,
+			value: &schemas.StartedEvent{
+				Event: constants.Started,
+				Player: &schemas.StartedEventPlayer{
+					X:      pl.X,
+					Y:      pl.Y,
+					Weight: pl.Weight,
+					Color:  pl.Color,
+					Points: benchPoints(pl),
+				},
+				Spikes: spikes,
+				Food:   benchFood(benchFoodCount),
+			},
+			newValue: func() interface{} { return &schemas.StartedEvent{} },
+		},
+		{
+			name:     "Move",
+			schema:   schemas.MoveSchema,
+			value:    &schemas.MoveEvent{Event: constants.Move, NewX: 5120.5, NewY: 4096.25},
+			newValue: func() interface{} { return &schemas.MoveEvent{} },
+		},
+		{
+			name:   "Moved",
+			schema: schemas.MovedSchema,
+			value: &schemas.MovedEvent{
+				Event:     constants.Moved,
+				X:         pl.X,
+				Y:         pl.Y,
+				VelocityX: 12.5,
+				VelocityY: -3.25,
+				Weight:    pl.Weight,
+				Zoom:      pl.Zoom,
+				Points:    benchPoints(pl),
+			},
+			newValue: func() interface{} { return &schemas.MovedEvent{} },
+		},
+		{
+			name:     "StatsUpdate",
+			schema:   schemas.PlayerStatsSchema,
+			value:    &schemas.PlayerStatsEvent{Event: constants.StatsUpdate, TopPlayers: m.GetStats()},
+			newValue: func() interface{} { return &schemas.PlayerStatsEvent{} },
+		},
+		{
+			name:   "AdminStats",
+			schema: schemas.AdminStatsSchema,
+			value: &adminStatsEvent{
+				Event:        constants.StatsUpdate,
+				BotsCount:    uint16(m.Players.BotsCount()),
+				PlayersCount: 0,
+				TopsPlayers:  benchPlayers(m.Players.Players),
+			},
+			newValue: func() interface{} { return &adminStatsEvent{} },
+		},
+		{
+			name:     "FoodCreated",
+			schema:   schemas.FoodCreatedSchema,
+			value:    &schemas.FoodCreatedEvent{Event: constants.FoodCreated, Food: benchFood(benchFoodCount)},
+			newValue: func() interface{} { return &schemas.FoodCreatedEvent{} },
+		},
+		{
+			name:     "FoodEaten",
+			schema:   schemas.FoodEatenSchema,
+			value:    &schemas.FoodEatenEvent{Event: constants.FoodEaten, Ids: []entity.Id{4242, 4243, 4244}},
+			newValue: func() interface{} { return &schemas.FoodEatenEvent{} },
+		},
+		{
+			name:   "PlayersUpdate",
+			schema: schemas.PlayersUpdatedSchema,
+			value: &schemas.PlayersUpdatedEvent{
+				Event:   constants.PlayersUpdate,
+				Players: benchPlayers(m.Players.Closest(pl, constants.NumPlayersResponse)),
+			},
+			newValue: func() interface{} { return &schemas.PlayersUpdatedEvent{} },
+		},
+		{
+			name:     "Rip",
+			schema:   schemas.GenericSchema,
+			value:    &schemas.GenericEvent{Event: constants.Rip},
+			newValue: func() interface{} { return &schemas.GenericEvent{} },
+		},
+	}
+	for i := range messages {
+		messages[i].reused = messages[i].newValue()
+	}
+	return messages
+}
+
+// benchCodec abstracts the three encodings so that every message runs
+// through identical benchmark bodies.
+type benchCodec struct {
+	name   string
+	encode func(msg *benchMessage) ([]byte, error)
+	decode func(msg *benchMessage, data []byte) error
+}
+
+// gob codecs create a fresh encoder per message, since every websocket frame
+// has to be decodable on its own and so carries its own type information.
+var benchCodecs = []benchCodec{
+	{
+		name: "csbin",
+		encode: func(msg *benchMessage) ([]byte, error) {
+			writer, err := msg.schema.Encode(msg.value)
+			if err != nil {
+				return nil, err
+			}
+			return writer.Bytes(), nil
+		},
+		decode: func(msg *benchMessage, data []byte) error {
+			return msg.schema.Decode(data, msg.newValue())
+		},
+	},
+	{
+		name: "csbin-reuse",
+		encode: func(msg *benchMessage) ([]byte, error) {
+			writer, err := msg.schema.Encode(msg.value)
+			if err != nil {
+				return nil, err
+			}
+			return writer.Bytes(), nil
+		},
+		decode: func(msg *benchMessage, data []byte) error {
+			return msg.schema.DecodeInto(data, msg.reused)
+		},
+	},
+	{
+		name: "json",
+		encode: func(msg *benchMessage) ([]byte, error) {
+			return json.Marshal(msg.value)
+		},
+		decode: func(msg *benchMessage, data []byte) error {
+			return json.Unmarshal(data, msg.newValue())
+		},
+	},
+	{
+		name: "gob",
+		encode: func(msg *benchMessage) ([]byte, error) {
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(msg.value); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+		decode: func(msg *benchMessage, data []byte) error {
+			return gob.NewDecoder(bytes.NewReader(data)).Decode(msg.newValue())
+		},
+	},
+}
+
+func BenchmarkEncode(b *testing.B) {
+	messages := benchMessages()
+	for i := range messages {
+		msg := &messages[i]
+		for _, codec := range benchCodecs {
+			codec := codec
+			b.Run(msg.name+"/"+codec.name, func(b *testing.B) {
+				var size int
+				b.ReportAllocs()
+				for n := 0; n < b.N; n++ {
+					data, err := codec.encode(msg)
+					if err != nil {
+						b.Fatal(err)
+					}
+					size = len(data)
+				}
+				b.ReportMetric(float64(size), "bytes/msg")
+			})
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	messages := benchMessages()
+	for i := range messages {
+		msg := &messages[i]
+		for _, codec := range benchCodecs {
+			codec := codec
+			data, err := codec.encode(msg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(msg.name+"/"+codec.name, func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(data)))
+				for n := 0; n < b.N; n++ {
+					if err := codec.decode(msg, data); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(data)), "bytes/msg")
+			})
+		}
+	}
+}
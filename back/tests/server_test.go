@@ -0,0 +1,222 @@
+package tests
+
+import (
+	"github.com/diyor28/not-agar/src/gamengine"
+	"github.com/diyor28/not-agar/src/gamengine/constants"
+	"github.com/diyor28/not-agar/src/gamengine/schemas"
+	"github.com/diyor28/not-agar/src/sockethub"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// startServer runs a GameServer of two player rooms torn down as soon as
+// they are empty, configure is called before the server starts.
+func startServer(t *testing.T, configure func(server *gamengine.GameServer)) (*gamengine.GameServer, *sockethub.MemoryTransport) {
+	server := gamengine.NewGameServer(50)
+	server.MaxPlayers = 2
+	server.IdleTimeout = 0
+	server.Configure = func(eng *gamengine.GameEngine) {
+		eng.SessionGrace = 0
+	}
+	if configure != nil {
+		configure(server)
+	}
+	transport := sockethub.NewMemoryTransport()
+	go server.Run()
+	go server.Hub.Serve(transport)
+	shutdownHub(t, server.Hub)
+	t.Cleanup(server.Stop)
+	return server, transport
+}
+
+func joinRoom(t *testing.T, transport *sockethub.MemoryTransport, room string) sockethub.Conn {
+	conn := dialEngine(t, transport)
+	send(t, conn, schemas.StartSchema, &startEvent{Event: constants.Start, Nickname: "tester", Room: room})
+	return conn
+}
+
+// drain discards what conn receives from now on, so that the hub doesn't
+// drop it as a slow consumer.
+func drain(conn sockethub.Conn) {
+	go func() {
+		for {
+			if _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func waitRooms(t *testing.T, server *gamengine.GameServer, want []gamengine.RoomStats) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rooms := server.Rooms()
+		if reflect.DeepEqual(rooms, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rooms %+v, expected %+v", rooms, want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestGameServerRooms(t *testing.T) {
+	server, transport := startServer(t, nil)
+	var public []sockethub.Conn
+	for i := 0; i < 3; i++ {
+		conn := joinRoom(t, transport, "")
+		expectEvent(t, conn, constants.Started, schemas.StartedSchema, &schemas.StartedEvent{})
+		drain(conn)
+		public = append(public, conn)
+	}
+	for i := 0; i < 2; i++ {
+		friends := joinRoom(t, transport, "friends")
+		expectEvent(t, friends, constants.Started, schemas.StartedSchema, &schemas.StartedEvent{})
+		drain(friends)
+	}
+	waitRooms(t, server, []gamengine.RoomStats{
+		{Name: "friends", Clients: 2, Players: 2},
+		{Name: "room-1", Public: true, Clients: 2, Players: 2},
+		{Name: "room-2", Public: true, Clients: 1, Players: 1},
+	})
+
+	// named rooms are capped too and never receive unnamed clients
+	full := joinRoom(t, transport, "friends")
+	expectEvent(t, full, constants.RoomFull, schemas.GenericSchema, &schemas.GenericEvent{})
+	if rooms := server.Rooms(); len(rooms) != 3 || rooms[0].Clients != 2 {
+		t.Fatalf("rejected client was placed: %+v", rooms)
+	}
+
+	// empty rooms are torn down, and the others refilled first
+	public[2].Close()
+	waitRooms(t, server, []gamengine.RoomStats{
+		{Name: "friends", Clients: 2, Players: 2},
+		{Name: "room-1", Public: true, Clients: 2, Players: 2},
+	})
+	public[0].Close()
+	waitRooms(t, server, []gamengine.RoomStats{
+		{Name: "friends", Clients: 2, Players: 2},
+		{Name: "room-1", Public: true, Clients: 1, Players: 1},
+	})
+	conn := joinRoom(t, transport, "")
+	expectEvent(t, conn, constants.Started, schemas.StartedSchema, &schemas.StartedEvent{})
+	drain(conn)
+	waitRooms(t, server, []gamengine.RoomStats{
+		{Name: "friends", Clients: 2, Players: 2},
+		{Name: "room-1", Public: true, Clients: 2, Players: 2},
+	})
+}
+
+func TestGameServerMaxRooms(t *testing.T) {
+	server, transport := startServer(t, func(server *gamengine.GameServer) {
+		server.MaxRooms = 2
+	})
+	for _, name := range []string{"first", "second"} {
+		conn := joinRoom(t, transport, name)
+		expectEvent(t, conn, constants.Started, schemas.StartedSchema, &schemas.StartedEvent{})
+		drain(conn)
+	}
+
+	// neither named nor public rooms are opened past the cap
+	for _, name := range []string{"third", ""} {
+		conn := joinRoom(t, transport, name)
+		expectEvent(t, conn, constants.RoomFull, schemas.GenericSchema, &schemas.GenericEvent{})
+	}
+	want := []gamengine.RoomStats{
+		{Name: "first", Clients: 1, Players: 1},
+		{Name: "second", Clients: 1, Players: 1},
+	}
+	if rooms := server.Rooms(); !reflect.DeepEqual(rooms, want) {
+		t.Fatalf("rooms %+v, expected %+v", rooms, want)
+	}
+
+	// the rooms running still take players
+	conn := joinRoom(t, transport, "first")
+	expectEvent(t, conn, constants.Started, schemas.StartedSchema, &schemas.StartedEvent{})
+}
+
+func TestGameServerResume(t *testing.T) {
+	server, transport := startServer(t, func(server *gamengine.GameServer) {
+		server.Configure = func(eng *gamengine.GameEngine) {
+			eng.SessionGrace = time.Minute
+		}
+	})
+	conn := joinRoom(t, transport, "friends")
+	started := &schemas.StartedEvent{}
+	expectEvent(t, conn, constants.Started, schemas.StartedSchema, started)
+	conn.Close()
+
+	conn = dialEngine(t, transport)
+	send(t, conn, schemas.ResumeSchema, &schemas.ResumeEvent{Event: constants.Resume, Session: started.Session})
+	resumed := &schemas.StartedEvent{}
+	expectEvent(t, conn, constants.Started, schemas.StartedSchema, resumed)
+	if resumed.Player.Color != started.Player.Color {
+		t.Fatal("resumed a different player")
+	}
+	waitRooms(t, server, []gamengine.RoomStats{{Name: "friends", Clients: 1, Players: 1}})
+}
+
+func TestGameServerDetachedKeepsSlot(t *testing.T) {
+	server, transport := startServer(t, func(server *gamengine.GameServer) {
+		server.Configure = func(eng *gamengine.GameEngine) {
+			eng.SessionGrace = time.Minute
+		}
+	})
+	var sessions []*schemas.StartedEvent
+	var conns []sockethub.Conn
+	for i := 0; i < 2; i++ {
+		conn := joinRoom(t, transport, "friends")
+		started := &schemas.StartedEvent{}
+		expectEvent(t, conn, constants.Started, schemas.StartedSchema, started)
+		drain(conn)
+		conns = append(conns, conn)
+		sessions = append(sessions, started)
+	}
+	conns[0].Close()
+	// the client leaves once its player waits for it, holding the slot
+	waitRooms(t, server, []gamengine.RoomStats{{Name: "friends", Clients: 1, Players: 2}})
+	conn := joinRoom(t, transport, "friends")
+	expectEvent(t, conn, constants.RoomFull, schemas.GenericSchema, &schemas.GenericEvent{})
+
+	// which the player gets back although the room is full
+	conn = dialEngine(t, transport)
+	send(t, conn, schemas.ResumeSchema, &schemas.ResumeEvent{Event: constants.Resume, Session: sessions[0].Session})
+	expectEvent(t, conn, constants.Started, schemas.StartedSchema, &schemas.StartedEvent{})
+	waitRooms(t, server, []gamengine.RoomStats{{Name: "friends", Clients: 2, Players: 2}})
+}
+
+func TestGameServerResumeZeroSession(t *testing.T) {
+	_, transport := startServer(t, nil)
+	conn := dialEngine(t, transport)
+	send(t, conn, schemas.ResumeSchema, &schemas.ResumeEvent{Event: constants.Resume})
+	expectEvent(t, conn, constants.ResumeFailed, schemas.GenericSchema, &schemas.GenericEvent{})
+	conn = joinRoom(t, transport, "")
+	expectEvent(t, conn, constants.Started, schemas.StartedSchema, &schemas.StartedEvent{})
+}
+
+func TestGameServerAnnouncements(t *testing.T) {
+	broker := sockethub.NewMemoryBroker()
+	defer broker.Close()
+	share := func(server *gamengine.GameServer) {
+		server.Hub.UseBroker(broker, gamengine.GlobalRoom)
+	}
+	first, firstTransport := startServer(t, share)
+	_, secondTransport := startServer(t, share)
+	conns := []sockethub.Conn{joinRoom(t, firstTransport, ""), joinRoom(t, secondTransport, "")}
+	for _, conn := range conns {
+		expectEvent(t, conn, constants.Started, schemas.StartedSchema, &schemas.StartedEvent{})
+	}
+
+	if err := first.Announce("restarting soon"); err != nil {
+		t.Fatal(err)
+	}
+	for i, conn := range conns {
+		announcement := &schemas.AnnouncementEvent{}
+		expectEvent(t, conn, constants.Announcement, schemas.AnnouncementSchema, announcement)
+		if announcement.Message != "restarting soon" {
+			t.Fatalf("client %d received %q", i, announcement.Message)
+		}
+	}
+}
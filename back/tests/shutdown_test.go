@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"context"
+	"github.com/diyor28/not-agar/src/sockethub"
+	"github.com/gorilla/websocket"
+	"testing"
+	"time"
+)
+
+func TestHubShutdown(t *testing.T) {
+	hub := sockethub.NewHub()
+	connected := make(chan *sockethub.Client, 2)
+	hub.OnConnect(func(client *sockethub.Client) {
+		connected <- client
+	})
+	reasons := make(chan sockethub.DisconnectReason, 2)
+	hub.OnDisconnect(func(client *sockethub.Client, reason sockethub.DisconnectReason) {
+		reasons <- reason
+	})
+	url := serveWebsocket(t, hub, sockethub.NewWebsocketTransport(websocket.Upgrader{}))
+	conns := []*websocket.Conn{dialWebsocket(t, url), dialWebsocket(t, url)}
+	for _, conn := range conns {
+		defer conn.Close()
+		client := <-connected
+		// queued before the shutdown, so it has to be flushed first
+		if err := client.Emit([]byte{42}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := hub.ShutdownWithReason(ctx, sockethub.CloseServiceRestart, "server restarting"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if reason := <-reasons; reason != sockethub.ReasonShutdown {
+			t.Fatalf("expected reason %v, got %v", sockethub.ReasonShutdown, reason)
+		}
+	}
+	for _, conn := range conns {
+		_, data, err := conn.ReadMessage()
+		if err != nil || len(data) != 1 || data[0] != 42 {
+			t.Fatalf("expected the queued message, got %v, %v", data, err)
+		}
+		_, _, err = conn.ReadMessage()
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok || closeErr.Code != sockethub.CloseServiceRestart || closeErr.Text != "server restarting" {
+			t.Fatalf("expected a close frame, got %v", err)
+		}
+	}
+
+	server, _ := sockethub.Pipe()
+	if hub.AddConn(server) != nil {
+		t.Fatal("a connection was added after Shutdown")
+	}
+}
+
+func TestHubShutdownDeadline(t *testing.T) {
+	config := sockethub.DefaultConfig()
+	config.WriteWait = 0
+	config.SendQueuePolicy = sockethub.DropOldest
+	hub := sockethub.NewHubWithConfig(config)
+	connected := make(chan *sockethub.Client, 1)
+	hub.OnConnect(func(client *sockethub.Client) {
+		connected <- client
+	})
+	transport := sockethub.NewMemoryTransport()
+	serveHub(t, hub, transport)
+	conn, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := <-connected
+	// the peer never reads, so the writer blocks once the pipe is full
+	for i := 0; i < 200; i++ {
+		client.Emit([]byte{byte(i)})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := hub.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if !client.IsClosed() {
+		t.Fatal("client was not closed after the deadline")
+	}
+	if _, err := transport.Dial(); err != sockethub.ErrTransportClosed {
+		t.Fatalf("expected the transport to be closed, got %v", err)
+	}
+}
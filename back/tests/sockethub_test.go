@@ -0,0 +1,518 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/diyor28/not-agar/src/sockethub"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveHub runs hub on transport until the test ends, the hub is then shut
+// down along with its transports and clients.
+func serveHub(t testing.TB, hub *sockethub.Hub, transport sockethub.Transport) {
+	go hub.Run()
+	go hub.Serve(transport)
+	shutdownHub(t, hub)
+}
+
+// shutdownHub shuts hub down when the test ends, for hubs run by an engine.
+func shutdownHub(t testing.TB, hub *sockethub.Hub) {
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := hub.Shutdown(ctx); err != nil {
+			t.Error("hub did not shut down: ", err)
+		}
+	})
+}
+
+// serveWebsocket serves hub on transport through an httptest server and
+// returns the url to dial.
+func serveWebsocket(t testing.TB, hub *sockethub.Hub, transport *sockethub.WebsocketTransport) string {
+	server := httptest.NewServer(transport)
+	t.Cleanup(server.Close)
+	serveHub(t, hub, transport)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func dialWebsocket(t *testing.T, url string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// discard reads and drops everything sent to conn until it is closed.
+func discard(conn *websocket.Conn) {
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+type disconnectEvent struct {
+	client *sockethub.Client
+	reason sockethub.DisconnectReason
+}
+
+func TestHubLifecycleHooks(t *testing.T) {
+	hub := sockethub.NewHub()
+	connected := make(chan *sockethub.Client, 4)
+	disconnected := make(chan disconnectEvent, 4)
+	hub.OnConnect(func(client *sockethub.Client) {
+		connected <- client
+	})
+	hub.OnDisconnect(func(client *sockethub.Client, reason sockethub.DisconnectReason) {
+		disconnected <- disconnectEvent{client, reason}
+	})
+	url := serveWebsocket(t, hub, sockethub.NewWebsocketTransport(websocket.Upgrader{}))
+
+	conn := dialWebsocket(t, url)
+	go discard(conn)
+	var client *sockethub.Client
+	select {
+	case client = <-connected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnConnect was not called")
+	}
+	err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	select {
+	case event := <-disconnected:
+		if event.client != client {
+			t.Fatal("OnDisconnect called with a different client")
+		}
+		if event.reason != sockethub.ReasonClosed {
+			t.Fatalf("expected reason %v, got %v", sockethub.ReasonClosed, event.reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnDisconnect was not called")
+	}
+	if err := client.Emit([]byte{1}); err != sockethub.ErrClosed {
+		t.Fatalf("expected ErrClosed after disconnect, got %v", err)
+	}
+	select {
+	case event := <-disconnected:
+		t.Fatalf("OnDisconnect called twice, second reason %v", event.reason)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHubIdleTimeout(t *testing.T) {
+	config := sockethub.DefaultConfig()
+	config.PingInterval = 20 * time.Millisecond
+	config.IdleTimeout = 100 * time.Millisecond
+	hub := sockethub.NewHubWithConfig(config)
+	disconnected := make(chan sockethub.DisconnectReason, 1)
+	hub.OnDisconnect(func(client *sockethub.Client, reason sockethub.DisconnectReason) {
+		disconnected <- reason
+	})
+	url := serveWebsocket(t, hub, sockethub.NewWebsocketTransport(websocket.Upgrader{}))
+	defer dialWebsocket(t, url).Close()
+
+	select {
+	case reason := <-disconnected:
+		if reason != sockethub.ReasonTimeout {
+			t.Fatalf("expected reason %v, got %v", sockethub.ReasonTimeout, reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle client was not disconnected")
+	}
+}
+
+// TestClientConcurrentEmitClose is meant to be run with -race, emitting,
+// broadcasting and changing rooms while the client is being closed must
+// neither race nor panic.
+func TestClientConcurrentEmitClose(t *testing.T) {
+	config := sockethub.DefaultConfig()
+	config.SendQueuePolicy = sockethub.DropOldest
+	hub := sockethub.NewHubWithConfig(config)
+	connected := make(chan *sockethub.Client, 1)
+	disconnected := make(chan sockethub.DisconnectReason, 2)
+	hub.OnConnect(func(client *sockethub.Client) {
+		connected <- client
+	})
+	hub.OnDisconnect(func(client *sockethub.Client, reason sockethub.DisconnectReason) {
+		disconnected <- reason
+	})
+	url := serveWebsocket(t, hub, sockethub.NewWebsocketTransport(websocket.Upgrader{}))
+	conn := dialWebsocket(t, url)
+	defer conn.Close()
+	go discard(conn)
+	client := <-connected
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			room := fmt.Sprintf("room/%d", i)
+			for n := 0; n < 200; n++ {
+				client.Join(room)
+				if err := client.Emit([]byte{byte(n)}); err != nil && err != sockethub.ErrClosed {
+					t.Error(err)
+				}
+				hub.Emit([]byte{byte(n)}, room)
+				client.IsInChannel(room)
+				client.Leave(room)
+			}
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Millisecond)
+			client.Close()
+		}()
+	}
+	wg.Wait()
+
+	if !client.IsClosed() {
+		t.Fatal("client is not closed")
+	}
+	if err := client.Emit([]byte{1}); err != sockethub.ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	select {
+	case reason := <-disconnected:
+		if reason != sockethub.ReasonServer {
+			t.Fatalf("expected reason %v, got %v", sockethub.ReasonServer, reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnDisconnect was not called")
+	}
+	select {
+	case <-disconnected:
+		t.Fatal("OnDisconnect called twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// flush emits a marker to every client and returns what each one received
+// before it. Clients send in order, so everything emitted earlier is included.
+func flush(t *testing.T, conns []*websocket.Conn, clients []*sockethub.Client) [][]byte {
+	marker := []byte{0xff}
+	res := make([][]byte, len(conns))
+	for i, conn := range conns {
+		if err := clients[i].Emit(marker); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(data, marker) {
+				break
+			}
+			res[i] = append(res[i], data...)
+		}
+	}
+	return res
+}
+
+func TestHubRooms(t *testing.T) {
+	hub := sockethub.NewHub()
+	connected := make(chan *sockethub.Client, 3)
+	hub.OnConnect(func(client *sockethub.Client) {
+		connected <- client
+	})
+	url := serveWebsocket(t, hub, sockethub.NewWebsocketTransport(websocket.Upgrader{}))
+	conns := make([]*websocket.Conn, 3)
+	clients := make([]*sockethub.Client, 3)
+	for i := range conns {
+		conns[i] = dialWebsocket(t, url)
+		defer conns[i].Close()
+		clients[i] = <-connected
+	}
+	clients[0].Join("red")
+	clients[0].Join("spectators")
+	clients[1].Join("red")
+	clients[2].Join("blue")
+
+	if counts := hub.RoomCounts(); !reflect.DeepEqual(counts, map[string]int{"red": 2, "blue": 1, "spectators": 1}) {
+		t.Fatalf("unexpected room counts %v", counts)
+	}
+	if rooms := clients[0].Rooms(); !reflect.DeepEqual(rooms, []string{"red", "spectators"}) {
+		t.Fatalf("unexpected rooms %v", rooms)
+	}
+	if !clients[1].IsInChannel("red") || clients[1].IsInChannel("blue") {
+		t.Fatal("wrong membership for client 1")
+	}
+
+	// a client in two of the rooms only gets one copy
+	hub.EmitTo([]byte{1}, "red", "spectators")
+	if got := flush(t, conns, clients); !reflect.DeepEqual(got, [][]byte{{1}, {1}, nil}) {
+		t.Fatalf("EmitTo delivered %v", got)
+	}
+	hub.EmitExcept([]byte{2}, clients[0], "red", "blue")
+	if got := flush(t, conns, clients); !reflect.DeepEqual(got, [][]byte{nil, {2}, {2}}) {
+		t.Fatalf("EmitExcept delivered %v", got)
+	}
+
+	clients[0].Leave("spectators")
+	clients[1].Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for hub.RoomSize("red") != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if counts := hub.RoomCounts(); !reflect.DeepEqual(counts, map[string]int{"red": 1, "blue": 1}) {
+		t.Fatalf("unexpected room counts after leaving %v", counts)
+	}
+	if members := hub.InRoom("red"); len(members) != 1 || members[0] != clients[0] {
+		t.Fatalf("unexpected members of red %v", members)
+	}
+}
+
+func TestHubClientIds(t *testing.T) {
+	hub := sockethub.NewHub()
+	connected := make(chan *sockethub.Client, 2)
+	disconnected := make(chan *sockethub.Client, 2)
+	hub.OnConnect(func(client *sockethub.Client) {
+		connected <- client
+	})
+	hub.OnDisconnect(func(client *sockethub.Client, reason sockethub.DisconnectReason) {
+		disconnected <- client
+	})
+	transport := sockethub.NewMemoryTransport()
+	serveHub(t, hub, transport)
+
+	first, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	a, b := <-connected, <-connected
+	if a.ID() == "" || a.ID() == b.ID() {
+		t.Fatalf("ids are not unique: %q, %q", a.ID(), b.ID())
+	}
+	if client, ok := hub.Get(b.ID()); !ok || client != b {
+		t.Fatal("Get did not find the client")
+	}
+	if err := hub.EmitToClient(b.ID(), []byte("direct")); err != nil {
+		t.Fatal(err)
+	}
+	// Serve adds connections in the order they were dialed
+	if data, err := second.ReadMessage(); err != nil || string(data) != "direct" {
+		t.Fatalf("expected the direct message, got %q, %v", data, err)
+	}
+
+	first.Close()
+	gone := <-disconnected
+	if _, ok := hub.Get(gone.ID()); ok {
+		t.Fatal("Get found a disconnected client")
+	}
+	if err := hub.EmitToClient(gone.ID(), []byte("late")); err != sockethub.ErrUnknownClient {
+		t.Fatalf("expected ErrUnknownClient, got %v", err)
+	}
+}
+
+func TestHubRoundTrips(t *testing.T) {
+	config := sockethub.DefaultConfig()
+	config.PingInterval = 20 * time.Millisecond
+	config.PongWait = time.Second
+	hub := sockethub.NewHubWithConfig(config)
+	connected := make(chan *sockethub.Client, 1)
+	hub.OnConnect(func(client *sockethub.Client) {
+		connected <- client
+	})
+	transport := sockethub.NewMemoryTransport()
+	serveHub(t, hub, transport)
+	conn, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := <-connected
+	// pings are only answered once the peer reads, the first one is sent
+	// 20ms in
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		for {
+			if _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	var stats sockethub.ClientStats
+	for deadline := time.Now().Add(2 * time.Second); stats.RTT == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		stats = client.Stats()
+	}
+	if stats.RTT < 50*time.Millisecond {
+		t.Fatalf("expected the first round trip to include the time the peer took to read, got %v", stats.RTT)
+	}
+}
+
+func TestHubStats(t *testing.T) {
+	config := sockethub.DefaultConfig()
+	config.PingInterval = 20 * time.Millisecond
+	config.PongWait = time.Second
+	hub := sockethub.NewHubWithConfig(config)
+	connected := make(chan *sockethub.Client, 1)
+	hub.OnConnect(func(client *sockethub.Client) {
+		client.Join("players")
+		connected <- client
+	})
+	hub.OnMessage(func(data []byte, client *sockethub.Client) {})
+	transport := sockethub.NewMemoryTransport()
+	serveHub(t, hub, transport)
+	conn, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// reading answers the hub's pings
+	received := make(chan []byte, 8)
+	go func() {
+		for {
+			data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- data
+		}
+	}()
+	client := <-connected
+
+	for i := 0; i < 3; i++ {
+		if err := conn.WriteMessage([]byte{7, 0, 0, 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Emit([]byte{9, 1}); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+
+	var stats sockethub.ClientStats
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		hubStats := hub.Stats()
+		if len(hubStats.Clients) != 1 {
+			t.Fatalf("expected a single client, got %d", len(hubStats.Clients))
+		}
+		stats = hubStats.Clients[0]
+		if stats.RTT > 0 && stats.Events[7].MessagesIn == 3 && stats.Events[9].MessagesOut == 1 {
+			break
+		}
+	}
+	if stats.ID != client.ID() || !reflect.DeepEqual(stats.Rooms, []string{"players"}) {
+		t.Fatalf("unexpected client %+v", stats)
+	}
+	if stats.RTT <= 0 || stats.SmoothedRTT <= 0 {
+		t.Error("no round trip measured")
+	}
+	want := map[byte]sockethub.EventTraffic{
+		7: {MessagesIn: 3, BytesIn: 12},
+		9: {MessagesOut: 1, BytesOut: 2},
+	}
+	if !reflect.DeepEqual(stats.Events, want) {
+		t.Errorf("got traffic %+v, expected %+v", stats.Events, want)
+	}
+	if total := stats.Total(); total.MessagesIn != 3 || total.MessagesOut != 1 {
+		t.Errorf("unexpected total %+v", total)
+	}
+}
+
+func TestHubPriorities(t *testing.T) {
+	const normal, urgent, count = 0, 1, 300
+	config := sockethub.DefaultConfig()
+	// the lanes share the bound, leave room for the urgent message
+	config.SendQueueSize = count + 1
+	config.Priorities = map[byte]sockethub.Priority{urgent: sockethub.PriorityHigh}
+	hub := sockethub.NewHubWithConfig(config)
+	connected := make(chan *sockethub.Client, 1)
+	hub.OnConnect(func(client *sockethub.Client) {
+		connected <- client
+	})
+	transport := sockethub.NewMemoryTransport()
+	serveHub(t, hub, transport)
+	conn, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := <-connected
+
+	// nothing is read until everything is queued, so the writer is stuck on
+	// the first normal messages when the urgent one is emitted
+	for i := 0; i < count; i++ {
+		if err := client.Emit([]byte{normal}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Emit([]byte{urgent}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= count; i++ {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[0] == urgent {
+			if i > count/2 {
+				t.Fatalf("urgent message arrived after %d normal ones", i)
+			}
+			return
+		}
+	}
+	t.Fatal("urgent message never arrived")
+}
+
+func TestHubUpgraderConfig(t *testing.T) {
+	config := sockethub.DefaultConfig()
+	config.ReadLimit = 16
+	config.AllowedOrigins = []string{"http://game.example"}
+	hub := sockethub.NewHubWithConfig(config)
+	disconnected := make(chan sockethub.DisconnectReason, 1)
+	hub.OnDisconnect(func(client *sockethub.Client, reason sockethub.DisconnectReason) {
+		disconnected <- reason
+	})
+	url := serveWebsocket(t, hub, sockethub.NewWebsocketTransport(config.Upgrader()))
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://evil.example"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("foreign origin was not refused: %v", err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://game.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.BinaryMessage, make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, sockethub.CloseMessageTooBig) {
+		t.Fatalf("expected close code %d, got %v", sockethub.CloseMessageTooBig, err)
+	}
+	select {
+	case reason := <-disconnected:
+		if reason != sockethub.ReasonMessageTooBig {
+			t.Fatalf("disconnected for %v", reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("client was not disconnected")
+	}
+}
@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/diyor28/not-agar/src/sockethub"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testStreamEcho(t *testing.T, network, address string) {
+	config := sockethub.DefaultConfig()
+	config.PingInterval = 20 * time.Millisecond
+	config.PongWait = 100 * time.Millisecond
+	config.ReadLimit = 1 << 20
+	transport, err := sockethub.ListenStream(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := sockethub.NewHubWithConfig(config)
+	hub.OnMessage(func(data []byte, client *sockethub.Client) {
+		if err := client.Emit(data); err != nil {
+			t.Error(err)
+		}
+	})
+	serveHub(t, hub, transport)
+
+	conn, err := sockethub.DialStream(network, transport.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// pings sent between messages are answered by the next ReadMessage
+	large := bytes.Repeat([]byte{7}, 200000)
+	for _, message := range [][]byte{{1, 2, 3}, large, {}} {
+		time.Sleep(60 * time.Millisecond)
+		if err := conn.WriteMessage(message); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, message) {
+			t.Fatalf("echoed %d bytes, sent %d", len(data), len(message))
+		}
+	}
+}
+
+func TestStreamTransportTCP(t *testing.T) {
+	testStreamEcho(t, "tcp", "127.0.0.1:0")
+}
+
+func TestStreamTransportUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sockethub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testStreamEcho(t, "unix", filepath.Join(dir, "hub.sock"))
+}
+
+func TestStreamAuthentication(t *testing.T) {
+	auth := sockethub.NewTokenAuth([]byte("secret"))
+	transport, err := sockethub.ListenStream("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.SetAuthenticator(auth)
+	hub := sockethub.NewHub()
+	identities := make(chan *sockethub.Identity, 1)
+	hub.OnConnect(func(client *sockethub.Client) {
+		identities <- client.Identity()
+	})
+	serveHub(t, hub, transport)
+	addr := transport.Addr().String()
+
+	rejected := map[string]func() (sockethub.Conn, error){
+		"missing token": func() (sockethub.Conn, error) {
+			return sockethub.DialStream("tcp", addr)
+		},
+		"forged token": func() (sockethub.Conn, error) {
+			return sockethub.DialStreamWithToken("tcp", addr, sockethub.NewTokenAuth([]byte("other")).Issue("bob", time.Minute))
+		},
+	}
+	for name, dial := range rejected {
+		conn, err := dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a data frame instead of the token is rejected as well
+		conn.WriteMessage([]byte{1})
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.ReadMessage(); err != io.EOF {
+			t.Fatalf("%s: expected the connection to be closed, got %v", name, err)
+		}
+		conn.Close()
+	}
+
+	conn, err := sockethub.DialStreamWithToken("tcp", addr, auth.Issue("bot", time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case identity := <-identities:
+		if identity == nil || identity.Subject != "bot" {
+			t.Fatalf("unexpected identity %+v", identity)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("authenticated client was not connected")
+	}
+	select {
+	case <-identities:
+		t.Fatal("a rejected client was connected")
+	default:
+	}
+}
+
+func TestStreamSingleCloseFrame(t *testing.T) {
+	server, client := net.Pipe()
+	conn := sockethub.NewStreamConn(server)
+	go func() {
+		conn.WriteClose(sockethub.CloseNormalClosure, "bye")
+		conn.Close()
+	}()
+	data, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each frame is a kind byte and a big-endian uint32 length
+	var kinds []byte
+	for len(data) >= 5 {
+		size := int(binary.BigEndian.Uint32(data[1:5]))
+		kinds = append(kinds, data[0])
+		data = data[5+size:]
+	}
+	if len(kinds) != 1 {
+		t.Fatalf("expected a single close frame, got frames of kinds %v", kinds)
+	}
+}
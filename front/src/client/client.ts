@@ -2,6 +2,8 @@ import {SocketWrapper} from "./socket";
 import {StatsUpdate} from "../engine/GameEngine";
 import {FoodData, InitialData, MoveCommand, MovedEvent, PlayerData} from "./types";
 import {
+	announcementSchema,
+	batchSchema,
 	foodCreatedSchema,
 	foodEatenSchema,
 	GameEvent,
@@ -10,28 +12,33 @@ import {
 	moveSchema,
 	pingSchema,
 	playersSchema,
+	resumeSchema,
 	startedSchema,
 	startSchema,
 	statsSchema
 } from './schemas'
 import {EventBus} from "./eventBus";
 
-type MixedGameEvent = 'open' | 'error' | GameEvent;
+type MixedGameEvent = 'open' | 'error' | 'close' | GameEvent;
 type GameData =
 	Event
 	| MovedEvent
 	| InitialData
 	| { players: PlayerData[] }
-	| { id: number }
+	| { ids: number[] }
 	| { food: FoodData[] }
 	| { topPlayers: StatsUpdate[] }
-	| { ping: number };
+	| { ping: number }
+	| { message: string };
 type GameCallback = (() => void) | ((data: GameData) => void);
 
 export class GameClient {
 	ping: number | null = null;
 	socket: SocketWrapper;
 	pingInterval: number
+	// session is handed out by the server in Started and lets the player
+	// resume after a reconnect, it is cleared when the player dies
+	session?: number[];
 	private bus: EventBus;
 
 	constructor(url: string, pingInterval: number) {
@@ -45,32 +52,10 @@ export class GameClient {
 		this.socket.on('error', (event) => {
 			this.bus.emit('error', event);
 		});
-		this.socket.on('message', (data) => {
-			const {event} = genericSchema.decode(data);
-			switch (event) {
-				case GameEvent.Moved:
-					return this.bus.emit(event, movedSchema.decode(data));
-				case GameEvent.Started:
-					return this.bus.emit(event, startedSchema.decode(data));
-				case GameEvent.PlayersUpdate:
-					return this.bus.emit(event, playersSchema.decode(data));
-				case GameEvent.FoodEaten:
-					return this.bus.emit(event, foodEatenSchema.decode(data));
-				case GameEvent.FoodCreated:
-					return this.bus.emit(event, foodCreatedSchema.decode(data));
-				case GameEvent.StatsUpdate:
-					return this.bus.emit(event, statsSchema.decode(data));
-				case GameEvent.Pong:
-					const {timestamp} = pingSchema.decode(data);
-					const ping = new Date().getTime() - timestamp;
-					this.ping = ping;
-					return this.bus.emit(event, {ping});
-				case GameEvent.Rip:
-					return this.bus.emit(event, {});
-				default:
-					console.log(`Received unknown event: ${event}`)
-			}
+		this.socket.on('close', (event) => {
+			this.bus.emit('close', event);
 		});
+		this.socket.on('message', this.handleMessage.bind(this));
 	}
 
 	connect() {
@@ -79,50 +64,138 @@ export class GameClient {
 
 	on(event: 'open', callback: (data: Event) => void): void
 	on(event: 'error', callback: (data: Event) => void): void
+	on(event: 'close', callback: (data: CloseEvent) => void): void
 	on(event: GameEvent.Moved, callback: (data: MovedEvent) => void): void
 	on(event: GameEvent.Started, callback: (data: InitialData) => void): void
 	on(event: GameEvent.PlayersUpdate, callback: (data: { players: PlayerData[] }) => void): void
-	on(event: GameEvent.FoodEaten, callback: (data: { id: number }) => void): void
+	on(event: GameEvent.FoodEaten, callback: (data: { ids: number[] }) => void): void
 	on(event: GameEvent.FoodCreated, callback: (data: { food: FoodData[] }) => void): void
 	on(event: GameEvent.StatsUpdate, callback: (data: { topPlayers: StatsUpdate[] }) => void): void
 	on(event: GameEvent.Pong, callback: (data: { ping: number }) => void): void
 	on(event: GameEvent.Rip, callback: () => void): void
+	on(event: GameEvent.ResumeFailed, callback: () => void): void
+	on(event: GameEvent.RoomFull, callback: () => void): void
+	on(event: GameEvent.Announcement, callback: (data: { message: string }) => void): void
 	on(event: MixedGameEvent, callback: GameCallback) {
 		this.bus.on(event, callback);
 	}
 
 	once(event: 'open', callback: (data: Event) => void): void
 	once(event: 'error', callback: (data: Event) => void): void
+	once(event: 'close', callback: (data: CloseEvent) => void): void
 	once(event: GameEvent.Moved, callback: (data: MovedEvent) => void): void
 	once(event: GameEvent.Started, callback: (data: InitialData) => void): void
 	once(event: GameEvent.PlayersUpdate, callback: (data: { players: PlayerData[] }) => void): void
-	once(event: GameEvent.FoodEaten, callback: (data: { id: number }) => void): void
+	once(event: GameEvent.FoodEaten, callback: (data: { ids: number[] }) => void): void
 	once(event: GameEvent.FoodCreated, callback: (data: { food: FoodData[] }) => void): void
 	once(event: GameEvent.StatsUpdate, callback: (data: { topPlayers: StatsUpdate[] }) => void): void
 	once(event: GameEvent.Pong, callback: (data: { ping: number }) => void): void
 	once(event: GameEvent.Rip, callback: () => void): void
+	once(event: GameEvent.ResumeFailed, callback: () => void): void
+	once(event: GameEvent.RoomFull, callback: () => void): void
+	once(event: GameEvent.Announcement, callback: (data: { message: string }) => void): void
 	once(event: MixedGameEvent, callback: GameCallback) {
 		this.bus.once(event, callback);
 	}
 
-	async startGame({nickname}: { nickname: string }): Promise<InitialData> {
-		const data = startSchema.encode({event: GameEvent.Start, nickname});
+	// startGame joins the room called room, or any room with a free slot when
+	// it is empty, and rejects when the server has no slot left in that room.
+	async startGame({nickname, room = ''}: { nickname: string, room?: string }): Promise<InitialData> {
+		const data = startSchema.encode({event: GameEvent.Start, nickname, room});
+		const result = new Promise<InitialData>((resolve, reject) => {
+			const started = (data: InitialData) => {
+				this.bus.off(GameEvent.RoomFull, full);
+				resolve(data);
+			}
+			const full = () => {
+				this.bus.off(GameEvent.Started, started);
+				reject(new Error(`Room ${room} is full`));
+			}
+			this.bus.once(GameEvent.Started, started);
+			this.bus.once(GameEvent.RoomFull, full);
+		});
 		this.socket.emit(data.toBuffer());
-		const result = await new Promise<InitialData>(resolve => this.bus.on(GameEvent.Started, resolve));
-		result.player.points.forEach(point => {
-			point.x /= 100
-			point.y /= 100
+		return this.initialData(await result);
+	}
+
+	// resume reconnects and takes back the player of the current session,
+	// resolving to null when there is no session or the server has let it go.
+	async resume(): Promise<InitialData | null> {
+		if (!this.session)
+			return null;
+		await this.socket.connect();
+		const result = new Promise<InitialData | null>(resolve => {
+			const started = (data: InitialData) => {
+				this.bus.off(GameEvent.ResumeFailed, failed);
+				resolve(this.initialData(data));
+			}
+			const failed = () => {
+				this.bus.off(GameEvent.Started, started);
+				this.session = undefined;
+				resolve(null);
+			}
+			this.bus.once(GameEvent.Started, started);
+			this.bus.once(GameEvent.ResumeFailed, failed);
 		});
+		this.socket.emit(resumeSchema.encode({event: GameEvent.Resume, session: this.session}).toBuffer());
 		return result;
 	}
 
 	move(data: MoveCommand) {
+		if (!this.socket.isOpen)
+			return;
 		this.socket.emit(moveSchema.encode({event: GameEvent.Move, ...data}).toBuffer());
 	}
 
+	private initialData(result: InitialData) {
+		this.session = result.session;
+		result.player.points.forEach(point => {
+			point.x /= 100
+			point.y /= 100
+		});
+		return result;
+	}
+
 	private pingPong() {
 		const data = {timestamp: new Date().getTime()};
-		this.socket.emit(pingSchema.encode({event: GameEvent.Ping, ...data}).toBuffer())
+		if (this.socket.isOpen)
+			this.socket.emit(pingSchema.encode({event: GameEvent.Ping, ...data}).toBuffer())
 		setTimeout(() => this.pingPong(), this.pingInterval);
 	}
+
+	private handleMessage(data: Buffer) {
+		const {event} = genericSchema.decode(data);
+		switch (event) {
+			case GameEvent.Moved:
+				return this.bus.emit(event, movedSchema.decode(data));
+			case GameEvent.Started:
+				return this.bus.emit(event, startedSchema.decode(data));
+			case GameEvent.PlayersUpdate:
+				return this.bus.emit(event, playersSchema.decode(data));
+			case GameEvent.FoodEaten:
+				return this.bus.emit(event, foodEatenSchema.decode(data));
+			case GameEvent.FoodCreated:
+				return this.bus.emit(event, foodCreatedSchema.decode(data));
+			case GameEvent.StatsUpdate:
+				return this.bus.emit(event, statsSchema.decode(data));
+			case GameEvent.Pong:
+				const {timestamp} = pingSchema.decode(data);
+				const ping = new Date().getTime() - timestamp;
+				this.ping = ping;
+				return this.bus.emit(event, {ping});
+			case GameEvent.Rip:
+				this.session = undefined;
+				return this.bus.emit(event, {});
+			case GameEvent.Announcement:
+				return this.bus.emit(event, announcementSchema.decode(data));
+			case GameEvent.ResumeFailed:
+			case GameEvent.RoomFull:
+				return this.bus.emit(event, {});
+			case GameEvent.Batch:
+				const {messages} = batchSchema.decode(data);
+				return messages.forEach((message: Buffer) => this.handleMessage(message));
+			default:
+				console.log(`Received unknown event: ${event}`)
+		}
+	}
 }
@@ -11,7 +11,7 @@ export class EventBus {
 				indices.push(index);
 			}
 		});
-		for (let i = indices.length; i >= 0; i --) {
+		for (let i = indices.length - 1; i >= 0; i --) {
 			this.listeners.splice(indices[i], 1);
 		}
 	}
@@ -11,7 +11,12 @@ export enum GameEvent {
 	FoodCreated,
 	PlayersUpdate,
 	StatsUpdate,
-	Rip
+	Rip,
+	Batch,
+	Resume,
+	ResumeFailed,
+	RoomFull,
+	Announcement
 }
 
 export const genericSchema = new Schema({
@@ -22,6 +27,10 @@ export const pingSchema = genericSchema.extends({
 	timestamp: 'uint64'
 });
 
+export const announcementSchema = genericSchema.extends({
+	message: 'string'
+});
+
 export const moveSchema = genericSchema.extends({
 	newX: 'float32',
 	newY: 'float32'
@@ -42,7 +51,8 @@ export const movedSchema = genericSchema.extends({
 });
 
 export const startSchema = genericSchema.extends({
-	nickname: {type: 'string', maxLen: 255}
+	nickname: {type: 'string', maxLen: 255},
+	room: {type: 'string', maxLen: 64}
 });
 
 export const startedSchema = genericSchema.extends({
@@ -76,7 +86,12 @@ export const startedSchema = genericSchema.extends({
 			color: {type: 'array', of: 'uint8', length: 3}
 		},
 		maxLen: 10_000
-	}
+	},
+	session: {type: 'array', of: 'uint8', length: 16}
+});
+
+export const resumeSchema = genericSchema.extends({
+	session: {type: 'array', of: 'uint8', length: 16}
 });
 
 export const foodCreatedSchema = genericSchema.extends({
@@ -94,7 +109,7 @@ export const foodCreatedSchema = genericSchema.extends({
 });
 
 export const foodEatenSchema = genericSchema.extends({
-	id: 'uint32'
+	ids: {type: 'array', of: 'uint32', maxLen: 10_000}
 });
 
 export const playersSchema = genericSchema.extends({
@@ -123,3 +138,10 @@ export const statsSchema = genericSchema.extends({
 });
 
 export const ripSchema = genericSchema;
+
+export const batchSchema = genericSchema.extends({
+	messages: {
+		type: 'array',
+		of: {type: 'buffer', maxLen: 0xffffffff}
+	}
+});
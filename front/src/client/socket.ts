@@ -32,23 +32,32 @@ export class SocketWrapper {
 		this.socket.onerror = (event: Event) => {
 			this.bus.emit('error', event);
 		}
+		this.socket.onclose = (event: CloseEvent) => {
+			this.bus.emit('close', event);
+		}
 		this.socket.onmessage = this.handleMessage.bind(this);
 		return connectPromise
 	}
 
 	once(event: 'open', callback: (data: Event) => void): void
 	once(event: 'error', callback: (data: Event) => void): void
-	once(event: 'open' | 'error', callback: (data: Event) => void): void {
+	once(event: 'close', callback: (data: CloseEvent) => void): void
+	once(event: 'open' | 'error' | 'close', callback: (data: Event) => void): void {
 		this.bus.once(event, callback);
 	}
 
 	on(event: 'open', callback: (data: Event) => void): void
 	on(event: 'error', callback: (data: Event) => void): void
+	on(event: 'close', callback: (data: CloseEvent) => void): void
 	on(event: 'message', callback: (data: Buffer) => void): void
-	on(event: 'open' | 'error' | 'message', callback: ((data: Event) => void) | ((data: Buffer) => void)): void {
+	on(event: 'open' | 'error' | 'close' | 'message', callback: ((data: Event) => void) | ((data: Buffer) => void)): void {
 		this.bus.on(event, callback);
 	}
 
+	get isOpen() {
+		return this.socket?.readyState === WebSocket.OPEN;
+	}
+
 	close(code?: number, reason?: string) {
 		if (!this.socket)
 			throw new Error('Call socket.connect first')
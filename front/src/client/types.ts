@@ -48,4 +48,5 @@ export interface InitialData {
 	player: SelfPlayerData
 	spikes: SpikeData[]
 	food: FoodData[]
+	session: number[]
 }
\ No newline at end of file
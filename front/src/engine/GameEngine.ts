@@ -42,12 +42,12 @@
 //     }
 // }
 import Player, {SelfPlayer} from "./player";
-import {isMobile} from "./utils";
+import {isMobile, socketUrl} from "./utils";
 import Food from "./food";
 import p5Types from "p5";
 import Spike from "./spike"; //Import this for typechecking and intellisense
 import JoyStick from "./joystick";
-import {FoodData, GameClient, MovedEvent, PlayerData, SpikeData} from "../client";
+import {FoodData, GameClient, InitialData, MovedEvent, PlayerData, SpikeData} from "../client";
 import {GameEvent} from "../client/schemas";
 
 export type StatsUpdate = {
@@ -65,6 +65,7 @@ export default class Game {
     public started = false;
     public _zoom: number;
     private readonly socketUrl: string;
+    private reconnecting = false;
     public width: number;
     public height: number;
     public joystick: JoyStick;
@@ -77,7 +78,7 @@ export default class Game {
         this.stats = [];
         this.spikes = [];
         this._zoom = 1.0;
-        this.socketUrl = process.env.REACT_APP_WS_URL as string;
+        this.socketUrl = socketUrl(process.env.REACT_APP_WS_URL as string);
         this.client = new GameClient(this.socketUrl, 1000);
         this.joystick = new JoyStick(width, height);
     }
@@ -90,17 +91,45 @@ export default class Game {
         return this.client.ping;
     }
 
-    async startGame({nickname}: { nickname: string }) {
-        const {player, spikes, food} = await this.client.startGame({nickname});
-        this.selfPlayer = new SelfPlayer({...player, nickname}, this.height, this.width);
-        this.started = true;
-        this.initSpikes(spikes);
-        this.initFood(food);
+    async startGame({nickname, room}: { nickname: string, room?: string }) {
+        const data = await this.client.startGame({nickname, room});
+        this.init(data, nickname);
         this.client.on(GameEvent.Moved, this.onMoved.bind(this));
         this.client.on(GameEvent.PlayersUpdate, this.playersUpdated.bind(this));
         this.client.on(GameEvent.FoodEaten, this.foodEaten.bind(this));
         this.client.on(GameEvent.FoodCreated, this.foodCreated.bind(this));
         this.client.on(GameEvent.StatsUpdate, this.onStatsUpdate.bind(this));
+        this.client.on('close', () => this.reconnect(nickname));
+    }
+
+    init({player, spikes, food}: InitialData, nickname: string) {
+        this.selfPlayer = new SelfPlayer({...player, nickname}, this.height, this.width);
+        this.started = true;
+        this.initSpikes(spikes);
+        this.initFood(food);
+    }
+
+    // reconnect tries to resume the session a few times after the connection
+    // drops, the game stops once the server no longer holds the player.
+    async reconnect(nickname: string) {
+        if (this.reconnecting || !this.started || !this.client.session)
+            return;
+        this.reconnecting = true;
+        for (let attempt = 1; attempt <= 5; attempt ++) {
+            try {
+                const data = await this.client.resume();
+                if (data)
+                    this.init(data, nickname);
+                else
+                    this.started = false;
+                this.reconnecting = false;
+                return;
+            } catch (e) {
+                await new Promise(resolve => setTimeout(resolve, 1000 * attempt));
+            }
+        }
+        this.started = false;
+        this.reconnecting = false;
     }
 
     windowResized(width: number, height: number) {
@@ -138,13 +167,9 @@ export default class Game {
         })
     }
 
-    foodEaten(data: { id: number }) {
-        for (let i = 0; i < this.food.length; i ++) {
-            if (this.food[i].id == data.id) {
-                this.food.splice(i, 1)
-                break
-            }
-        }
+    foodEaten(data: { ids: number[] }) {
+        const eaten = new Set(data.ids);
+        this.food = this.food.filter(food => !eaten.has(food.id));
     }
 
     foodCreated(data: { food: FoodData[] }) {
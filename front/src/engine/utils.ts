@@ -19,4 +19,14 @@ export function calcDistance(x1: number, y1: number, x2: number, y2: number) {
 
 export function isMobile() {
     return /Android|webOS|iPhone|iPad|iPod|BlackBerry|IEMobile|Opera Mini/i.test(navigator.userAgent)
-}
\ No newline at end of file
+}
+// socketUrl passes on the token given in the page URL, e.g. ?token=..., to
+// servers that require one to connect
+export function socketUrl(url: string) {
+    const token = new URLSearchParams(window.location.search).get('token')
+    if (!token)
+        return url
+    const result = new URL(url)
+    result.searchParams.set('token', token)
+    return result.toString()
+}
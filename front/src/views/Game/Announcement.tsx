@@ -0,0 +1,16 @@
+import React from 'react';
+import '../../App.css'
+
+export interface Props {
+    message: string | null
+}
+
+export default class Announcement extends React.Component<Props, {}> {
+    render() {
+        if (!this.props.message)
+            return null
+        return (
+            <div className="announcement">{this.props.message}</div>
+        );
+    }
+}
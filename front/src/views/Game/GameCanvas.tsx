@@ -3,6 +3,7 @@ import Sketch from 'react-p5';
 import Game from "../../engine/GameEngine";
 import Stats from "./Stats";
 import Ping from "./Ping";
+import Announcement from "./Announcement";
 import RIP from "./RIP";
 import CreatePlayerModal from "./CreatePlayerModal";
 import Tips from "./Tips";
@@ -19,12 +20,19 @@ export default class GameCanvas extends React.Component<any, any> {
         show: false,
         stats: [],
         socketOpen: false,
-        ping: null
+        ping: null,
+        announcement: null as string | null
     };
 
     createPlayer = async (data: { nickname: string }) => {
         await this.game.client.connect();
-        await this.game.startGame(data);
+        const room = new URLSearchParams(window.location.search).get('room') || '';
+        try {
+            await this.game.startGame({...data, room});
+        } catch (e) {
+            alert(e.message);
+            return;
+        }
         this.game.client.on(GameEvent.StatsUpdate, (data) => {
             this.setState({stats: data.topPlayers});
         });
@@ -37,6 +45,15 @@ export default class GameCanvas extends React.Component<any, any> {
             this.setState({ping});
         });
 
+        // announcements stay up for ten seconds
+        this.game.client.on(GameEvent.Announcement, ({message}) => {
+            this.setState({announcement: message});
+            setTimeout(() => {
+                if (this.state.announcement === message)
+                    this.setState({announcement: null});
+            }, 10000);
+        });
+
         this.game.client.once(GameEvent.Rip, () => {
             this.setState({show: true});
         });
@@ -49,6 +66,7 @@ export default class GameCanvas extends React.Component<any, any> {
                 <CreatePlayerModal eventBus={this.eventBus} createPlayer={this.createPlayer}/>
                 {/*<PlayButton eventBus={this.eventBus}/>*/}
                 <Ping ping={this.state.ping}/>
+                <Announcement message={this.state.announcement}/>
                 <RIP show={this.state.show}/>
                 <Tips/>
                 <Stats stats={this.state.stats}/>